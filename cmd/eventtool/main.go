@@ -0,0 +1,303 @@
+// Command eventtool performs maintenance tasks on a game's event log.
+//
+// Usage:
+//
+//	eventtool <command> [flags]
+//
+// Commands:
+//
+//	rebuild-snapshots  discard all snapshots and recreate them from the event log
+//	compact            collapse runs of clicks into aggregate events
+//	convert            copy an event log into a new log in the JSON or binary format
+//	state              print the game state as of an event or a point in time
+//	diff               print how the game state changed between two events
+//	verify             replay the event log and check every event against the rules of the game
+//	fork               copy the event log up to an event into a new log to play on from there
+//	tail               print the events of the log and keep printing new ones as they are appended
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"sort"
+	"time"
+
+	"clicker2/game"
+	"clicker2/game/events"
+	"clicker2/game/eventstore"
+)
+
+// commands maps each subcommand name to the function that runs it.
+var commands = map[string]func(args []string) error{
+	"rebuild-snapshots": rebuildSnapshots,
+	"compact":           compact,
+	"convert":           convert,
+	"state":             state,
+	"diff":              diff,
+	"verify":            verify,
+	"fork":              fork,
+	"tail":              tail,
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: eventtool <command> [flags]")
+	fmt.Fprintln(os.Stderr, "commands: rebuild-snapshots, compact, convert, state, diff, verify, fork, tail")
+	os.Exit(2)
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+	}
+	run, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	if err := run(os.Args[2:]); err != nil {
+		log.Fatalf("%s: %v", os.Args[1], err)
+	}
+}
+
+// openLog opens the event log at path, which must exist.
+// Commands that only read the log leave it as it is, even if its tail is corrupt.
+func openLog(path string) (*eventstore.FileEventStore, error) {
+	es := eventstore.NewFileEventStore(path)
+	exists, err := es.Exists()
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("no event log at %s", path)
+	}
+	return es, nil
+}
+
+func rebuildSnapshots(args []string) error {
+	fs := flag.NewFlagSet("rebuild-snapshots", flag.ExitOnError)
+	logPath := fs.String("log", "events.log", "path of the event log")
+	interval := fs.Uint64("interval", game.DefaultSnapshotInterval, "number of events between snapshots")
+	fs.Parse(args)
+
+	es, err := openLog(*logPath)
+	if err != nil {
+		return err
+	}
+	written, err := game.RebuildSnapshots(es, game.NewSnapshotStore(*logPath), *interval)
+	if err != nil {
+		return err
+	}
+	log.Printf("wrote %d snapshots for %s", written, *logPath)
+	return nil
+}
+
+func compact(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	logPath := fs.String("log", "events.log", "path of the event log")
+	archive := fs.Bool("archive", true, "keep the original log next to the compacted one")
+	fs.Parse(args)
+
+	es, err := openLog(*logPath)
+	if err != nil {
+		return err
+	}
+	stats, err := es.Compact(*archive)
+	if err != nil {
+		return err
+	}
+	log.Printf("compacted %s: %d records -> %d records", *logPath, stats.RecordsIn, stats.RecordsOut)
+	for _, path := range stats.ArchivePaths {
+		log.Printf("original log archived to %s", path)
+	}
+	return nil
+}
+
+func convert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	in := fs.String("in", "events.log", "path of the event log to read")
+	out := fs.String("out", "", "path of the event log to write, must not exist")
+	format := fs.String("format", "binary", "format of the written log: json or binary")
+	fs.Parse(args)
+
+	if *out == "" {
+		return fmt.Errorf("-out is required")
+	}
+	src, err := openLog(*in)
+	if err != nil {
+		return err
+	}
+	opts := eventstore.DefaultFileStoreOptions
+	f, err := eventstore.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+	opts.Format = f
+
+	dst := eventstore.NewFileEventStoreWithOptions(*out, opts)
+	if exists, err := dst.Exists(); err != nil || exists {
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%s already exists", *out)
+	}
+	copied, err := eventstore.Convert(src, dst)
+	if closeErr := dst.Close(); err == nil && closeErr != nil {
+		return closeErr
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("converted %d records from %s to %s (%s)", copied-dst.Duplicates(), *in, *out, f)
+	if n := dst.Duplicates(); n > 0 {
+		log.Printf("dropped %d duplicate records", n)
+	}
+	return nil
+}
+
+func state(args []string) error {
+	fs := flag.NewFlagSet("state", flag.ExitOnError)
+	logPath := fs.String("log", "events.log", "path of the event log")
+	seq := fs.Uint64("seq", math.MaxUint64, "sequence number of the last event to apply")
+	at := fs.String("time", "", "apply the events dispatched up to this RFC 3339 time instead")
+	fs.Parse(args)
+
+	es, err := openLog(*logPath)
+	if err != nil {
+		return err
+	}
+	tl, err := game.NewTimeline(es)
+	if err != nil {
+		return err
+	}
+	if *at != "" {
+		t, err := time.Parse(time.RFC3339, *at)
+		if err != nil {
+			return err
+		}
+		err = tl.SeekTime(t)
+	} else {
+		err = tl.Seek(*seq)
+	}
+	if err != nil {
+		return err
+	}
+
+	s := tl.State()
+	fmt.Printf("sequence: %d\n", s.Sequence)
+	if !s.Timestamp.IsZero() {
+		fmt.Printf("time: %s\n", s.Timestamp.Format(time.RFC3339Nano))
+	}
+	fmt.Printf("dust: %d\ndamage: %d\nrock health: %d\n", s.Dust, s.Damage, s.RockHealth)
+	ids := make([]string, 0, len(s.Upgrades))
+	for id := range s.Upgrades {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		fmt.Printf("upgrade %s: %d\n", id, s.Upgrades[id])
+	}
+	return nil
+}
+
+func diff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	logPath := fs.String("log", "events.log", "path of the event log")
+	from := fs.Uint64("from", 0, "sequence number of the first point")
+	to := fs.Uint64("to", math.MaxUint64, "sequence number of the second point")
+	fs.Parse(args)
+
+	es, err := openLog(*logPath)
+	if err != nil {
+		return err
+	}
+	tl, err := game.NewTimeline(es)
+	if err != nil {
+		return err
+	}
+	d, err := tl.Diff(*from, *to)
+	if err != nil {
+		return err
+	}
+	fmt.Print(d)
+	return nil
+}
+
+func verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	logPath := fs.String("log", "events.log", "path of the event log")
+	key := fs.String("key", "", "also check the signatures of a log signed with this key")
+	fs.Parse(args)
+
+	fileStore, err := openLog(*logPath)
+	if err != nil {
+		return err
+	}
+	var es events.EventStore = fileStore
+	if *key != "" {
+		es = eventstore.NewSignedEventStore(es, []byte(*key))
+	}
+	checked, gerr := game.Verify(es)
+	if gerr != nil {
+		return fmt.Errorf("%s after %d valid records: %w", *logPath, checked, gerr)
+	}
+	log.Printf("verified %d records in %s", checked, *logPath)
+	return nil
+}
+
+func fork(args []string) error {
+	fs := flag.NewFlagSet("fork", flag.ExitOnError)
+	logPath := fs.String("log", "events.log", "path of the event log to fork")
+	seq := fs.Uint64("seq", 0, "sequence number of the last event to copy")
+	out := fs.String("out", "", "path of the new event log, must not exist")
+	fs.Parse(args)
+
+	if *out == "" {
+		return fmt.Errorf("-out is required")
+	}
+	es, err := openLog(*logPath)
+	if err != nil {
+		return err
+	}
+	info, err := es.Fork(*out, *seq)
+	if err != nil {
+		return err
+	}
+	log.Printf("forked %s at sequence %d into %s", info.Parent, info.Sequence, *out)
+	for parent := info.Parent; ; {
+		origin, err := eventstore.ReadForkInfo(parent)
+		if err != nil || origin == nil {
+			return err
+		}
+		log.Printf("%s was forked from %s at sequence %d", parent, origin.Parent, origin.Sequence)
+		parent = origin.Parent
+	}
+}
+
+func tail(args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	logPath := fs.String("log", "events.log", "path of the event log")
+	from := fs.Uint64("from", 0, "sequence number of the first event to print")
+	fs.Parse(args)
+
+	// Follow until interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err := eventstore.NewFileEventStore(*logPath).Follow(ctx, *from, func(record *events.Record) error {
+		data, err := json.Marshal(record.Event)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d %s %s %s\n", record.Sequence, record.Timestamp.Format(time.RFC3339Nano), record.Event.EventType(), data)
+		return nil
+	})
+	if err == context.Canceled {
+		return nil
+	}
+	return err
+}
@@ -1,5 +1,7 @@
 package errors
 
+import stderrors "errors"
+
 // ErrorCode represents a specific error condition in the game.
 type ErrorCode int
 
@@ -14,16 +16,44 @@ const (
 
 	// Event-related errors
 	ErrUnknownEventType
+	ErrUnsupportedEventVersion
+	ErrCorruptEventLog
+	ErrDispatchFailed
+	ErrInvariantViolated
+	ErrTamperedEventLog
+
+	// Save-related errors
+	ErrTamperedSave
+
+	// Refund-related errors
+	ErrNotRefundable
+	ErrRefundWindowClosed
+
+	// Phase-related errors
+	ErrChoicePending
+	ErrGameEnded
+	ErrNoChoicePending
 )
 
 // errorMessages maps ErrorCode to a default English message.
 // In a full i18n system, this would be loaded from locale files.
 var errorMessages = map[ErrorCode]string{
-	ErrUnknown:          "An unknown error occurred.",
-	ErrInsufficientDust: "Not enough dust to purchase upgrade.",
-	ErrUpgradeMaxLevel:  "Upgrade already at max level.",
-	ErrUpgradeNotFound:  "Upgrade not found.",
-	ErrUnknownEventType: "Unknown event type encountered.",
+	ErrUnknown:                 "An unknown error occurred.",
+	ErrInsufficientDust:        "Not enough dust to purchase upgrade.",
+	ErrUpgradeMaxLevel:         "Upgrade already at max level.",
+	ErrUpgradeNotFound:         "Upgrade not found.",
+	ErrNotRefundable:           "There is no purchase that can be refunded.",
+	ErrRefundWindowClosed:      "The purchase can no longer be refunded.",
+	ErrChoicePending:           "The Heart of the Mountain awaits your choice.",
+	ErrGameEnded:               "The game has ended.",
+	ErrNoChoicePending:         "There is no choice to make yet.",
+	ErrUnknownEventType:        "Unknown event type encountered.",
+	ErrUnsupportedEventVersion: "Event was written by a newer version of the game.",
+	ErrCorruptEventLog:         "The event log is corrupt.",
+	ErrDispatchFailed:          "The action could not be recorded.",
+	ErrInvariantViolated:       "The event log breaks a rule of the game.",
+	ErrTamperedEventLog:        "The event log has been tampered with.",
+	ErrTamperedSave:            "The save file has been tampered with.",
 }
 
 // GetErrorMessage returns the human-readable message for a given ErrorCode.
@@ -39,13 +69,30 @@ func GetErrorMessage(code ErrorCode) string {
 type GameError struct {
 	Code    ErrorCode
 	Message string
+	Err     error // Underlying cause, if any
 }
 
 func (e *GameError) Error() string {
-	if e.Message != "" {
-		return e.Message
+	msg := e.Message
+	if msg == "" {
+		msg = GetErrorMessage(e.Code)
+	}
+	if e.Err != nil {
+		return msg + ": " + e.Err.Error()
 	}
-	return GetErrorMessage(e.Code)
+	return msg
+}
+
+// Unwrap returns the underlying cause, so errors.Is and errors.As look through a GameError.
+func (e *GameError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is a GameError with the same code, so a bare
+// NewGameError(code) can be used as a sentinel with errors.Is.
+func (e *GameError) Is(target error) bool {
+	t, ok := target.(*GameError)
+	return ok && t.Code == e.Code
 }
 
 // NewGameError creates a new GameError with a given code and an optional custom message.
@@ -55,4 +102,24 @@ func NewGameError(code ErrorCode, msg ...string) *GameError {
 		ge.Message = msg[0]
 	}
 	return ge
-}
\ No newline at end of file
+}
+
+// WrapGameError creates a GameError with a given code around an underlying cause.
+func WrapGameError(code ErrorCode, err error, msg ...string) *GameError {
+	ge := NewGameError(code, msg...)
+	ge.Err = err
+	return ge
+}
+
+// AsGameError returns the GameError in err's chain, or wraps err as ErrUnknown if there is none.
+// It returns nil for a nil err.
+func AsGameError(err error) *GameError {
+	if err == nil {
+		return nil
+	}
+	var ge *GameError
+	if stderrors.As(err, &ge) {
+		return ge
+	}
+	return WrapGameError(ErrUnknown, err)
+}
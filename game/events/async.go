@@ -0,0 +1,193 @@
+package events
+
+import (
+	"log"
+	"sync"
+)
+
+// DefaultQueueSize is the queue size of asynchronous subscribers that do not set one.
+const DefaultQueueSize = 64
+
+// OverflowPolicy decides what happens to an event for an asynchronous subscriber whose queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes Dispatch wait until the subscriber has taken an event off its queue.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest queued event to make room for the new one.
+	OverflowDropOldest
+	// OverflowCoalesce discards the oldest queued event with the same key as the new one,
+	// which is queued last, so the subscriber sees the latest of them and still in dispatch
+	// order. It discards the oldest event if none matches.
+	OverflowCoalesce
+)
+
+// AsyncOptions configures the queue of an asynchronous subscriber.
+type AsyncOptions struct {
+	QueueSize int // DefaultQueueSize if zero
+	Overflow  OverflowPolicy
+	// CoalesceKey returns the key under which OverflowCoalesce merges queued records,
+	// the event type if nil.
+	CoalesceKey func(record *Record) string
+}
+
+// Subscription is an asynchronous subscriber registered with SubscribeAsync.
+// Its handler runs on a goroutine of its own, one record at a time and in dispatch order.
+type Subscription struct {
+	token   Token
+	filter  Filter
+	handler RecordHandler
+	opts    AsyncOptions
+
+	mu      sync.Mutex
+	cond    *sync.Cond // Signalled when records are queued or taken, or the queue is closed
+	queue   []*Record
+	dropped int
+	closed  bool
+	done    chan struct{} // Closed once the queue is drained after closing
+}
+
+// SubscribeAsync registers a handler that receives the dispatched events selected by filter through
+// a bounded queue, for side effects such as audio, analytics or autosaves that should not
+// hold up the game. Only events that were stored and applied are queued, replayed events are not.
+// Errors returned by the handler are logged. Close delivers every queued event before returning.
+func (ed *EventDispatcher) SubscribeAsync(filter Filter, handler RecordHandler, opts AsyncOptions) *Subscription {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.CoalesceKey == nil {
+		opts.CoalesceKey = func(record *Record) string { return record.Event.EventType() }
+	}
+	s := &Subscription{
+		filter:  filter,
+		handler: handler,
+		opts:    opts,
+		done:    make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.run()
+
+	ed.mu.Lock()
+	defer ed.mu.Unlock()
+	if ed.closed {
+		s.close()
+		return s
+	}
+	ed.lastToken++
+	s.token = ed.lastToken
+	ed.async = append(ed.async, s)
+	return s
+}
+
+// Token returns the token to pass to Unsubscribe.
+func (s *Subscription) Token() Token {
+	return s.token
+}
+
+// Dropped returns the number of events discarded or coalesced because the queue was full.
+func (s *Subscription) Dropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// push queues a record according to the overflow policy.
+func (s *Subscription) push(record *Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.queue) >= s.opts.QueueSize && !s.closed {
+		switch s.opts.Overflow {
+		case OverflowBlock:
+			s.cond.Wait()
+			continue
+		case OverflowCoalesce:
+			if i := s.coalesceIndex(record); i >= 0 {
+				s.queue = append(s.queue[:i], s.queue[i+1:]...)
+				s.dropped++
+				continue
+			}
+		}
+		s.queue = s.queue[1:]
+		s.dropped++
+	}
+	if s.closed {
+		return
+	}
+	s.queue = append(s.queue, record)
+	s.cond.Broadcast()
+}
+
+// coalesceIndex returns the position of the oldest queued record with the key of record, -1 if none.
+// The caller must hold s.mu.
+func (s *Subscription) coalesceIndex(record *Record) int {
+	key := s.opts.CoalesceKey(record)
+	for i, queued := range s.queue {
+		if s.opts.CoalesceKey(queued) == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// run passes queued records to the handler until the queue is closed and empty.
+func (s *Subscription) run() {
+	defer close(s.done)
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		record := s.queue[0]
+		s.queue = s.queue[1:]
+		s.cond.Broadcast()
+		s.mu.Unlock()
+
+		if err := s.handler(record); err != nil {
+			log.Printf("Async subscriber failed on %s event %d: %v", record.Event.EventType(), record.Sequence, err)
+		}
+	}
+}
+
+// close stops accepting records and waits until the queued ones were handled.
+func (s *Subscription) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	<-s.done
+}
+
+// publish queues a stored and applied record for the asynchronous subscribers that select it.
+func (ed *EventDispatcher) publish(record *Record) {
+	ed.mu.Lock()
+	subscribers := ed.async
+	ed.mu.Unlock()
+	for _, s := range subscribers {
+		if s.filter(record) {
+			s.push(record)
+		}
+	}
+}
+
+// Close stops the asynchronous subscribers once they have handled every queued event.
+// Dispatching to a closed dispatcher fails with ErrClosed. The event store is not closed.
+func (ed *EventDispatcher) Close() error {
+	ed.mu.Lock()
+	if ed.closed {
+		ed.mu.Unlock()
+		return nil
+	}
+	ed.closed = true
+	subscribers := ed.async
+	ed.async = nil
+	ed.mu.Unlock()
+
+	for _, s := range subscribers {
+		s.close()
+	}
+	return nil
+}
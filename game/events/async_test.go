@@ -0,0 +1,117 @@
+package events
+
+import (
+	stderrors "errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestSubscribeAsyncDrainsOnClose(t *testing.T) {
+	ed := NewEventDispatcher(&sliceStore{})
+	var mu sync.Mutex
+	var got []uint64
+	ed.SubscribeAsync(OfType("Click"), func(record *Record) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, record.Sequence)
+		return nil
+	}, AsyncOptions{QueueSize: 2}) // Blocks when full
+
+	for i := 0; i < 20; i++ {
+		if err := ed.Dispatch(&ClickEvent{}); err != nil {
+			t.Fatalf("Dispatch failed: %v", err)
+		}
+	}
+	ed.Dispatch(&HeartTakenEvent{}) // Not subscribed
+	if err := ed.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if len(got) != 20 {
+		t.Fatalf("Expected all 20 clicks to be delivered before Close returned, got %d", len(got))
+	}
+	for i, sequence := range got {
+		if sequence != uint64(i+1) {
+			t.Fatalf("Record %d delivered out of order: got sequence %d", i, sequence)
+		}
+	}
+	if err := ed.Dispatch(&ClickEvent{}); !stderrors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed after Close, got %v", err)
+	}
+}
+
+// blockedSubscriber subscribes a handler that waits for release before handling its first record.
+func blockedSubscriber(ed *EventDispatcher, opts AsyncOptions) (s *Subscription, got *[]*Record, release func()) {
+	started := make(chan struct{})
+	gate := make(chan struct{})
+	var records []*Record
+	first := true
+	s = ed.SubscribeAsync(OfType("Click"), func(record *Record) error {
+		if first {
+			first = false
+			close(started)
+			<-gate
+		}
+		records = append(records, record)
+		return nil
+	}, opts)
+	ed.Dispatch(&ClickEvent{DustGained: 0})
+	<-started // The first record is taken off the queue, the rest stay queued
+	return s, &records, func() { close(gate) }
+}
+
+func TestSubscribeAsyncDropOldest(t *testing.T) {
+	ed := NewEventDispatcher(nil)
+	s, got, release := blockedSubscriber(ed, AsyncOptions{QueueSize: 2, Overflow: OverflowDropOldest})
+	for i := 1; i <= 4; i++ {
+		ed.Dispatch(&ClickEvent{DustGained: i})
+	}
+	release()
+	ed.Close()
+
+	if s.Dropped() != 2 {
+		t.Errorf("Expected 2 dropped records, got %d", s.Dropped())
+	}
+	var dust []int
+	for _, record := range *got {
+		dust = append(dust, record.Event.(*ClickEvent).DustGained)
+	}
+	if len(dust) != 3 || dust[1] != 3 || dust[2] != 4 {
+		t.Errorf("Expected the first and the two newest clicks, got %v", dust)
+	}
+}
+
+func TestSubscribeAsyncCoalesce(t *testing.T) {
+	ed := NewEventDispatcher(nil)
+	s, got, release := blockedSubscriber(ed, AsyncOptions{
+		QueueSize: 4,
+		Overflow:  OverflowCoalesce,
+		CoalesceKey: func(record *Record) string {
+			if record.Event.(*ClickEvent).DustGained%2 == 0 {
+				return "even"
+			}
+			return "odd"
+		},
+	})
+	for i := 1; i <= 6; i++ {
+		ed.Dispatch(&ClickEvent{DustGained: i})
+	}
+	release()
+	ed.Close()
+
+	// Nothing is coalesced while the queue has room; once full, 5 replaces 1 and 6 replaces 2.
+	if s.Dropped() != 2 {
+		t.Errorf("Expected 2 coalesced records, got %d", s.Dropped())
+	}
+	var dust []int
+	for i, record := range *got {
+		dust = append(dust, record.Event.(*ClickEvent).DustGained)
+		if i > 0 && record.Sequence <= (*got)[i-1].Sequence {
+			t.Errorf("Expected records in dispatch order, got sequence %d after %d", record.Sequence, (*got)[i-1].Sequence)
+		}
+	}
+	if fmt.Sprint(dust) != "[0 3 4 5 6]" {
+		t.Errorf("Expected the blocked click and the latest four, got %v", dust)
+	}
+}
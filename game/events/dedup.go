@@ -0,0 +1,80 @@
+package events
+
+// DefaultDedupWindow is the number of event IDs a Dedup created by NewDedup remembers.
+// Retried records are expected to arrive well within this many records of the original;
+// merging logs that overlap further back needs a larger window or an unbounded one.
+const DefaultDedupWindow = 4096
+
+// Dedup remembers the IDs of the records it has seen so that records delivered twice,
+// e.g. resent after a retry or present in both of two merged logs, are applied once.
+// With a window only the IDs of the most recent records are kept, so memory stays bounded
+// however long the log grows, but a copy arriving after more than a window of other records
+// is not recognized; an unbounded Dedup recognizes every copy.
+// Records without an ID, written before IDs existed, are never considered duplicates.
+// A Dedup is not safe for concurrent use.
+type Dedup struct {
+	seen    map[string]struct{}
+	order   []string // Remembered IDs, oldest at next once the window is full
+	next    int
+	window  int // Zero remembers every ID
+	dropped int
+}
+
+// NewDedup creates a Dedup that has seen no records and remembers DefaultDedupWindow IDs.
+func NewDedup() *Dedup {
+	return NewDedupWindow(DefaultDedupWindow)
+}
+
+// NewDedupWindow creates a Dedup that has seen no records and remembers the last window IDs,
+// or every ID if window is zero or negative.
+func NewDedupWindow(window int) *Dedup {
+	if window < 0 {
+		window = 0
+	}
+	return &Dedup{seen: make(map[string]struct{}), window: window}
+}
+
+// Window returns the number of IDs d remembers, zero if it remembers every ID.
+func (d *Dedup) Window() int {
+	return d.window
+}
+
+// Add remembers the ID of a record, once it has been stored or applied,
+// forgetting the oldest remembered ID if the window is full.
+func (d *Dedup) Add(record *Record) {
+	if record.EventID == "" {
+		return
+	}
+	if _, ok := d.seen[record.EventID]; ok {
+		return
+	}
+	d.seen[record.EventID] = struct{}{}
+	if d.window == 0 {
+		return
+	}
+	if len(d.order) < d.window {
+		d.order = append(d.order, record.EventID)
+		return
+	}
+	delete(d.seen, d.order[d.next])
+	d.order[d.next] = record.EventID
+	d.next = (d.next + 1) % d.window
+}
+
+// Duplicate reports whether a record with the same ID was added before, counting it as dropped if so.
+// The record itself is not remembered, so that it can be retried if storing or applying it fails.
+func (d *Dedup) Duplicate(record *Record) bool {
+	if record.EventID == "" {
+		return false
+	}
+	if _, ok := d.seen[record.EventID]; ok {
+		d.dropped++
+		return true
+	}
+	return false
+}
+
+// Dropped returns the number of duplicates reported by Duplicate.
+func (d *Dedup) Dropped() int {
+	return d.dropped
+}
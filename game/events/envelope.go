@@ -0,0 +1,86 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"clicker2/game/errors"
+)
+
+// Envelope is the serialized form of an event as written by event stores.
+// Version is the schema version of Data; logs written before versioning
+// existed have no version and are treated as version 1.
+type Envelope struct {
+	Type    string `json:"type"`
+	Version int    `json:"version,omitempty"`
+	Metadata
+	Data json.RawMessage `json:"data"`
+}
+
+// Upcaster migrates the payload of an event from one schema version to the next.
+type Upcaster func(data json.RawMessage) (json.RawMessage, error)
+
+// upcasters maps an event type to its migration chain, indexed by the version it migrates from.
+var upcasters = make(map[string]map[int]Upcaster)
+
+// RegisterUpcaster registers the migration of eventType payloads from fromVersion to fromVersion+1.
+// The current schema version of an event type is one past its newest upcaster,
+// so bumping a schema is done by registering the upcaster that produces it.
+func RegisterUpcaster(eventType string, fromVersion int, up Upcaster) {
+	if fromVersion < 1 {
+		panic(fmt.Sprintf("events: invalid upcaster version %d for %q", fromVersion, eventType))
+	}
+	chain, ok := upcasters[eventType]
+	if !ok {
+		chain = make(map[int]Upcaster)
+		upcasters[eventType] = chain
+	}
+	if _, exists := chain[fromVersion]; exists {
+		panic(fmt.Sprintf("events: upcaster for %q from version %d registered twice", eventType, fromVersion))
+	}
+	chain[fromVersion] = up
+}
+
+// SchemaVersion returns the current schema version of an event type.
+func SchemaVersion(eventType string) int {
+	version := 1
+	for upcasters[eventType][version] != nil {
+		version++
+	}
+	return version
+}
+
+// Encode wraps an event in an envelope stamped with its current schema version.
+func Encode(event Event) (*Envelope, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event: %w", err)
+	}
+	return &Envelope{
+		Type:    event.EventType(),
+		Version: SchemaVersion(event.EventType()),
+		Data:    data,
+	}, nil
+}
+
+// DecodeEnvelope upcasts the envelope payload to the current schema version and decodes it.
+func DecodeEnvelope(env *Envelope) (Event, *errors.GameError) {
+	version := env.Version
+	if version == 0 {
+		version = 1
+	}
+	current := SchemaVersion(env.Type)
+	if version > current {
+		return nil, errors.NewGameError(errors.ErrUnsupportedEventVersion, fmt.Sprintf("%s event has version %d, newest known is %d", env.Type, version, current))
+	}
+
+	data := env.Data
+	for ; version < current; version++ {
+		var err error
+		data, err = upcasters[env.Type][version](data)
+		if err != nil {
+			return nil, errors.NewGameError(errors.ErrUnknown, fmt.Sprintf("failed to upcast %s event from version %d: %v", env.Type, version, err))
+		}
+	}
+	return Decode(env.Type, data)
+}
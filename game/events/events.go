@@ -1,7 +1,9 @@
 package events
 
 import (
-	"fmt" // Added import
+	"fmt"
+	"sync"
+	"time"
 )
 
 // Event is an interface for all domain events.
@@ -53,6 +55,25 @@ func (e *ClickEvent) EventType() string {
 	return "Click"
 }
 
+// ClicksAggregatedEvent replaces a run of consecutive ClickEvents when the event log is compacted.
+// Replaying it leaves the game in the same state as replaying the clicks it replaces.
+type ClicksAggregatedEvent struct {
+	PlayerID string
+	Clicks int
+	FirstSequence uint64 // Sequence number of the first click in the run
+	TotalDamage int
+	TotalDust int
+	RockHealthBefore int
+	RockHealthAfter int
+	PlayerDustBefore int
+	PlayerDustAfter int
+}
+
+// EventType returns the type of the ClicksAggregatedEvent.
+func (e *ClicksAggregatedEvent) EventType() string {
+	return "ClicksAggregated"
+}
+
 // HeartTakenEvent is dispatched when the player takes the heart of the mountain.
 type HeartTakenEvent struct {
 	PlayerID string
@@ -73,45 +94,262 @@ func (e *MountainRestedEvent) EventType() string {
 	return "MountainRested"
 }
 
+// PurchaseRefundedEvent undoes an UpgradePurchasedEvent shortly after it, e.g. after a misclick.
+// The dust spent is given back and the upgrade returns to the level it had before the purchase.
+type PurchaseRefundedEvent struct {
+	PlayerID         string
+	UpgradeID        string
+	PurchaseSequence uint64 // Sequence number of the refunded purchase
+	NewLevel         int    // Level restored by the refund
+	OldDust          int
+	NewDust          int
+}
+
+// EventType returns the type of the PurchaseRefundedEvent.
+func (e *PurchaseRefundedEvent) EventType() string {
+	return "PurchaseRefunded"
+}
+
+// ClickBurstEvent is derived from a run of clicks in quick succession, see package rules.
+type ClickBurstEvent struct {
+	PlayerID      string
+	Clicks        int
+	FirstSequence uint64        // Sequence number of the first click in the burst
+	LastSequence  uint64        // Sequence number of the click that completed it
+	Duration      time.Duration // Time between the first and the last click
+}
+
+// EventType returns the type of the ClickBurstEvent.
+func (e *ClickBurstEvent) EventType() string {
+	return "ClickBurst"
+}
+
+// SustainedMiningEvent is derived from clicks kept up without a pause for a while, see package rules.
+type SustainedMiningEvent struct {
+	PlayerID      string
+	Clicks        int
+	FirstSequence uint64        // Sequence number of the first click of the run
+	LastSequence  uint64        // Sequence number of the click that completed it
+	Duration      time.Duration // Time between the first and the last click
+}
+
+// EventType returns the type of the SustainedMiningEvent.
+func (e *SustainedMiningEvent) EventType() string {
+	return "SustainedMining"
+}
+
+func init() {
+	RegisterType("DamageUpgraded", func() Event { return &DamageUpgradedEvent{} })
+	RegisterType("UpgradePurchased", func() Event { return &UpgradePurchasedEvent{} })
+	RegisterType("Click", func() Event { return &ClickEvent{} })
+	RegisterType("ClicksAggregated", func() Event { return &ClicksAggregatedEvent{} })
+	RegisterType("HeartTaken", func() Event { return &HeartTakenEvent{} })
+	RegisterType("MountainRested", func() Event { return &MountainRestedEvent{} })
+	RegisterType("PurchaseRefunded", func() Event { return &PurchaseRefundedEvent{} })
+	RegisterType("ClickBurst", func() Event { return &ClickBurstEvent{} })
+	RegisterType("SustainedMining", func() Event { return &SustainedMiningEvent{} })
+}
+
 // EventHandler is a function that handles a specific event.
 type EventHandler func(event Event)
 
-// EventStore defines the interface for storing events.
-type EventStore interface { // Added EventStore interface
-	SaveEvent(event Event) error
-}
+// RecordHandler is a function that handles an event together with its metadata.
+// Returning an error rejects the event, see DispatchMode.
+type RecordHandler func(record *Record) error
+
+// DispatchMode decides what Dispatch does when persisting or applying an event fails.
+type DispatchMode int
+
+const (
+	// ApplyIfPersisted stores an event first and passes it to the handlers only once it is stored.
+	// A handler that rejects a stored event leaves the state behind the log.
+	ApplyIfPersisted DispatchMode = iota
+	// PersistIfApplied passes an event to the handlers first and stores it only if they all accept it.
+	// An event that cannot be stored after it was applied leaves the state ahead of the log.
+	PersistIfApplied
+)
 
 // EventDispatcher manages event handlers and dispatches events.
 type EventDispatcher struct {
-	handlers map[string][]EventHandler
 	eventStore EventStore // Added EventStore field
+	sessionID  string
+	sequence   uint64           // Sequence number of the last dispatched or replayed event
+	seeded     bool             // Whether sequence was advanced past the last record of the store, see seed
+	mode       DispatchMode     // ApplyIfPersisted unless changed with SetMode
+	middleware []Middleware     // In the order they were added
+	chain      DispatchFunc     // The middleware wrapped around store and notify
+	now        func() time.Time // Timestamps dispatched events, time.Now unless changed with SetClock
+
+	mu            sync.Mutex      // Protects the subscribers and closed
+	subscriptions []subscription  // Synchronous handlers in the order they were subscribed
+	async         []*Subscription // Asynchronous subscribers, see SubscribeAsync
+	lastToken     Token
+	closed        bool
 }
 
 // NewEventDispatcher creates a new EventDispatcher.
+// Each dispatcher starts a new session with its own session ID.
 func NewEventDispatcher(es EventStore) *EventDispatcher {
-	return &EventDispatcher{
-		handlers: make(map[string][]EventHandler),
+	ed := &EventDispatcher{
 		eventStore: es, // Can be nil for replay
+		sessionID:  NewID(),
+		now:        time.Now,
+	}
+	ed.chain = ed.storeAndNotify
+	return ed
+}
+
+// SessionID returns the ID of the session this dispatcher records events for.
+func (ed *EventDispatcher) SessionID() string {
+	return ed.sessionID
+}
+
+// LastSequence returns the sequence number of the last dispatched or replayed event.
+func (ed *EventDispatcher) LastSequence() uint64 {
+	return ed.sequence
+}
+
+// Resume sets the sequence number of the last event, e.g. after the game state
+// was restored from a snapshot instead of replaying every event.
+func (ed *EventDispatcher) Resume(sequence uint64) {
+	ed.sequence = sequence
+}
+
+// SetMode sets the order in which events are stored and applied.
+func (ed *EventDispatcher) SetMode(mode DispatchMode) {
+	ed.mode = mode
+}
+
+// SetClock sets the function that timestamps dispatched events, e.g. a fake clock in tests.
+func (ed *EventDispatcher) SetClock(now func() time.Time) {
+	ed.now = now
+}
+
+// Now returns the current time of the dispatcher's clock, see SetClock.
+func (ed *EventDispatcher) Now() time.Time {
+	return ed.now()
+}
+
+// Register registers an event handler for a specific event type, see Subscribe.
+func (ed *EventDispatcher) Register(eventType string, handler EventHandler) Token {
+	return ed.RegisterRecord(eventType, func(record *Record) error {
+		handler(record.Event)
+		return nil
+	})
+}
+
+// RegisterRecord registers a handler that also receives the event metadata, see Subscribe.
+func (ed *EventDispatcher) RegisterRecord(eventType string, handler RecordHandler) Token {
+	return ed.Subscribe(OfType(eventType), handler)
+}
+
+// Use adds middleware to the dispatch chain. The first middleware added sees each event first.
+// Middleware only runs for dispatched events; replayed events were accepted when they were recorded.
+func (ed *EventDispatcher) Use(middleware ...Middleware) {
+	ed.middleware = append(ed.middleware, middleware...)
+	ed.chain = ed.storeAndNotify
+	for i := len(ed.middleware) - 1; i >= 0; i-- {
+		ed.chain = ed.middleware[i](ed.chain)
 	}
 }
 
-// Register registers an event handler for a specific event type.
-func (ed *EventDispatcher) Register(eventType string, handler EventHandler) {
-	ed.handlers[eventType] = append(ed.handlers[eventType], handler)
+// Dispatch assigns metadata to an event and passes it through the middleware,
+// which persists it and passes it to all handlers subscribed to it.
+// It returns the error of the middleware that vetoed the event, of the store or of the
+// handler that rejected it; what was stored and applied by then depends on the DispatchMode.
+// An event that was not stored does not use up a sequence number. The first dispatch continues
+// numbering after the last record already in the store, so sessions sharing a log never reuse numbers.
+func (ed *EventDispatcher) Dispatch(event Event) error {
+	ed.mu.Lock()
+	closed := ed.closed
+	ed.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	if err := ed.seed(); err != nil {
+		return err
+	}
+
+	record := &Record{
+		Metadata: Metadata{
+			Sequence:  ed.sequence + 1,
+			Timestamp: ed.now(),
+			EventID:   NewID(),
+			SessionID: ed.sessionID,
+		},
+		Event: event,
+	}
+	return ed.chain(record)
+}
+
+// seed advances the sequence past the last record of the store before the first dispatch.
+// Replayed events or Resume may already have advanced it that far or further.
+func (ed *EventDispatcher) seed() error {
+	if ed.seeded || ed.eventStore == nil {
+		return nil
+	}
+	last, err := LastSequence(ed.eventStore)
+	if err != nil {
+		return fmt.Errorf("failed to read the last sequence number of the event store: %w", err)
+	}
+	if last > ed.sequence {
+		ed.sequence = last
+	}
+	ed.seeded = true
+	return nil
+}
+
+// storeAndNotify is the end of the dispatch chain.
+// Records that were stored and applied are then queued for the asynchronous subscribers.
+func (ed *EventDispatcher) storeAndNotify(record *Record) error {
+	first, second := ed.persist, ed.notify
+	if ed.mode == PersistIfApplied {
+		first, second = ed.notify, ed.persist
+	}
+	if err := first(record); err != nil {
+		return err
+	}
+	if err := second(record); err != nil {
+		return err
+	}
+	ed.publish(record)
+	return nil
 }
 
-// Dispatch dispatches an event to all registered handlers for its type.
-func (ed *EventDispatcher) Dispatch(event Event) {
+// persist appends a record to the store and advances the sequence once it is stored.
+func (ed *EventDispatcher) persist(record *Record) error {
 	if ed.eventStore != nil {
-		if err := ed.eventStore.SaveEvent(event); err != nil {
-			// TODO: Handle error, e.g., log it
-			fmt.Printf("Error saving event: %v\n", err)
+		if err := ed.eventStore.Append(record); err != nil {
+			return fmt.Errorf("failed to save %s event: %w", record.Event.EventType(), err)
 		}
 	}
+	ed.sequence = record.Sequence
+	return nil
+}
+
+// Replay passes a previously recorded event to the handlers without persisting it again.
+// The dispatcher continues numbering new events after the highest replayed sequence.
+// It returns the error of the first handler that rejects the event.
+func (ed *EventDispatcher) Replay(record *Record) error {
+	if record.Sequence > ed.sequence {
+		ed.sequence = record.Sequence
+	}
+	return ed.notify(record)
+}
 
-	if handlers, ok := ed.handlers[event.EventType()]; ok {
-		for _, handler := range handlers {
-			handler(event)
+// notify passes a record to the handlers subscribed to it in the order they were subscribed,
+// stopping at the first handler that rejects it.
+func (ed *EventDispatcher) notify(record *Record) error {
+	ed.mu.Lock()
+	subscriptions := ed.subscriptions
+	ed.mu.Unlock()
+	for _, s := range subscriptions {
+		if !s.filter(record) {
+			continue
+		}
+		if err := s.handler(record); err != nil {
+			return fmt.Errorf("%s event %d rejected: %w", record.Event.EventType(), record.Sequence, err)
 		}
 	}
+	return nil
 }
@@ -0,0 +1,245 @@
+package events
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"testing"
+	"time"
+
+	"clicker2/game/errors"
+)
+
+// renamedEvent is a test-only event whose schema went through two migrations:
+// v1 had "Amount", v2 renamed it to "Count" and v3 added "Source".
+type renamedEvent struct {
+	Count  int
+	Source string
+}
+
+func (e *renamedEvent) EventType() string {
+	return "TestRenamed"
+}
+
+func init() {
+	RegisterType("TestRenamed", func() Event { return &renamedEvent{} })
+	RegisterUpcaster("TestRenamed", 1, func(data json.RawMessage) (json.RawMessage, error) {
+		var v1 struct{ Amount int }
+		if err := json.Unmarshal(data, &v1); err != nil {
+			return nil, err
+		}
+		return json.Marshal(map[string]int{"Count": v1.Amount})
+	})
+	RegisterUpcaster("TestRenamed", 2, func(data json.RawMessage) (json.RawMessage, error) {
+		var v2 map[string]any
+		if err := json.Unmarshal(data, &v2); err != nil {
+			return nil, err
+		}
+		v2["Source"] = "legacy"
+		return json.Marshal(v2)
+	})
+}
+
+func TestRegistryDecodesAllBuiltinTypes(t *testing.T) {
+	for _, eventType := range []string{"DamageUpgraded", "UpgradePurchased", "Click", "ClicksAggregated", "HeartTaken", "MountainRested"} {
+		event, err := Decode(eventType, json.RawMessage(`{}`))
+		if err != nil {
+			t.Fatalf("Decode(%s) failed: %v", eventType, err.Error())
+		}
+		if event.EventType() != eventType {
+			t.Errorf("Decode(%s) returned %s event", eventType, event.EventType())
+		}
+	}
+
+	_, err := Decode("NoSuchEvent", json.RawMessage(`{}`))
+	if err == nil || err.Code != errors.ErrUnknownEventType {
+		t.Errorf("Expected unknown event type error with code %d, got %v", errors.ErrUnknownEventType, err)
+	}
+}
+
+func TestEnvelopeUpcasting(t *testing.T) {
+	if v := SchemaVersion("TestRenamed"); v != 3 {
+		t.Fatalf("SchemaVersion mismatch: got %d, want %d", v, 3)
+	}
+	if v := SchemaVersion("Click"); v != 1 {
+		t.Errorf("Click SchemaVersion mismatch: got %d, want %d", v, 1)
+	}
+
+	// An unversioned envelope predates versioning and is upcast from version 1.
+	event, err := DecodeEnvelope(&Envelope{Type: "TestRenamed", Data: json.RawMessage(`{"Amount":7}`)})
+	if err != nil {
+		t.Fatalf("DecodeEnvelope failed: %v", err.Error())
+	}
+	if e := event.(*renamedEvent); e.Count != 7 || e.Source != "legacy" {
+		t.Errorf("Upcast event mismatch: got %+v", e)
+	}
+
+	env, encErr := Encode(&renamedEvent{Count: 3, Source: "live"})
+	if encErr != nil {
+		t.Fatalf("Encode failed: %v", encErr)
+	}
+	if env.Version != 3 {
+		t.Errorf("Encoded version mismatch: got %d, want %d", env.Version, 3)
+	}
+	event, err = DecodeEnvelope(env)
+	if err != nil {
+		t.Fatalf("DecodeEnvelope failed: %v", err.Error())
+	}
+	if e := event.(*renamedEvent); e.Count != 3 || e.Source != "live" {
+		t.Errorf("Round-tripped event mismatch: got %+v", e)
+	}
+
+	_, err = DecodeEnvelope(&Envelope{Type: "TestRenamed", Version: 4, Data: json.RawMessage(`{}`)})
+	if err == nil || err.Code != errors.ErrUnsupportedEventVersion {
+		t.Errorf("Expected unsupported version error with code %d, got %v", errors.ErrUnsupportedEventVersion, err)
+	}
+}
+
+// sliceStore is a minimal EventStore that keeps appended records in memory.
+type sliceStore struct {
+	records []*Record
+}
+
+func (s *sliceStore) Append(record *Record) error {
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *sliceStore) ReadFrom(from uint64, fn func(record *Record) error) error {
+	for _, record := range s.records {
+		if record.Sequence < from {
+			continue
+		}
+		if err := fn(record); err != nil {
+			if err == ErrStop {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sliceStore) Flush() error { return nil }
+
+func (s *sliceStore) Close() error { return nil }
+
+func TestDispatcherAssignsMetadata(t *testing.T) {
+	store := &sliceStore{}
+	ed := NewEventDispatcher(store)
+
+	var handled []*Record
+	ed.RegisterRecord("Click", func(record *Record) error {
+		handled = append(handled, record)
+		return nil
+	})
+
+	before := time.Now()
+	ed.Dispatch(&ClickEvent{})
+	ed.Dispatch(&ClickEvent{})
+
+	if len(store.records) != 2 || len(handled) != 2 {
+		t.Fatalf("Expected 2 stored and handled records, got %d and %d", len(store.records), len(handled))
+	}
+	for i, record := range handled {
+		if record.Sequence != uint64(i+1) {
+			t.Errorf("Record %d sequence mismatch: got %d, want %d", i, record.Sequence, i+1)
+		}
+		if record.SessionID != ed.SessionID() {
+			t.Errorf("Record %d session mismatch: got %s, want %s", i, record.SessionID, ed.SessionID())
+		}
+		if record.EventID == "" || record.Timestamp.Before(before) {
+			t.Errorf("Record %d has incomplete metadata: %+v", i, record.Metadata)
+		}
+	}
+	if handled[0].EventID == handled[1].EventID {
+		t.Errorf("Expected unique event IDs, both are %s", handled[0].EventID)
+	}
+
+	// Replaying does not persist and moves the sequence forward.
+	replayer := NewEventDispatcher(store)
+	replayer.Replay(&Record{Metadata: Metadata{Sequence: 41}, Event: &ClickEvent{}})
+	replayer.Dispatch(&ClickEvent{})
+	if got := store.records[len(store.records)-1].Sequence; got != 42 {
+		t.Errorf("Sequence after replay mismatch: got %d, want %d", got, 42)
+	}
+	if len(store.records) != 3 {
+		t.Errorf("Replay should not persist, store has %d records", len(store.records))
+	}
+}
+
+// failingStore is an EventStore whose appends fail.
+type failingStore struct {
+	sliceStore
+}
+
+var errStoreFull = stderrors.New("store full")
+
+func (s *failingStore) Append(record *Record) error {
+	return errStoreFull
+}
+
+func TestDispatchModes(t *testing.T) {
+	// By default a record that cannot be stored is not applied.
+	ed := NewEventDispatcher(&failingStore{})
+	handled := 0
+	ed.Register("Click", func(event Event) { handled++ })
+	if err := ed.Dispatch(&ClickEvent{}); !stderrors.Is(err, errStoreFull) {
+		t.Errorf("Expected the store error, got %v", err)
+	}
+	if handled != 0 || ed.LastSequence() != 0 {
+		t.Errorf("Expected the unsaved event to be neither applied nor numbered, got %d handled and sequence %d", handled, ed.LastSequence())
+	}
+
+	// With PersistIfApplied a record the handlers reject is not stored.
+	store := &sliceStore{}
+	ed = NewEventDispatcher(store)
+	ed.SetMode(PersistIfApplied)
+	errNegative := stderrors.New("negative damage")
+	ed.RegisterRecord("Click", func(record *Record) error {
+		if record.Event.(*ClickEvent).DamageDealt < 0 {
+			return errNegative
+		}
+		return nil
+	})
+	if err := ed.Dispatch(&ClickEvent{DamageDealt: -1}); !stderrors.Is(err, errNegative) {
+		t.Errorf("Expected the handler error, got %v", err)
+	}
+	if err := ed.Dispatch(&ClickEvent{DamageDealt: 1}); err != nil {
+		t.Errorf("Dispatch failed: %v", err)
+	}
+	if len(store.records) != 1 || store.records[0].Sequence != 1 {
+		t.Errorf("Expected only the accepted event to be stored as sequence 1, got %v", store.records)
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	d := NewDedupWindow(2)
+	a, b, c := &Record{Metadata: Metadata{EventID: "a"}}, &Record{Metadata: Metadata{EventID: "b"}}, &Record{Metadata: Metadata{EventID: "c"}}
+	d.Add(a)
+	d.Add(b)
+	d.Add(a) // Already remembered, does not use up the window
+	if !d.Duplicate(a) || !d.Duplicate(b) || d.Duplicate(c) {
+		t.Fatalf("Expected a and b to be duplicates and c not")
+	}
+
+	// Adding c forgets a, the oldest ID.
+	d.Add(c)
+	if d.Duplicate(a) || !d.Duplicate(b) || !d.Duplicate(c) {
+		t.Errorf("Expected a to be forgotten once c was added")
+	}
+	if d.Dropped() != 4 {
+		t.Errorf("Expected 4 dropped records, got %d", d.Dropped())
+	}
+	if d.Duplicate(&Record{}) {
+		t.Errorf("Expected records without an ID never to be duplicates")
+	}
+
+	// Without a window every ID is remembered.
+	d = NewDedupWindow(0)
+	for _, record := range []*Record{a, b, c} {
+		d.Add(record)
+	}
+	if !d.Duplicate(a) || d.Window() != 0 {
+		t.Errorf("Expected an unbounded Dedup to remember the first ID")
+	}
+}
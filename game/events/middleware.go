@@ -0,0 +1,134 @@
+package events
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrRejected is wrapped by the errors of middleware that vetoes an event.
+var ErrRejected = errors.New("events: event rejected")
+
+// ErrRateLimited is returned, wrapping ErrRejected, for events dropped by RateLimit.
+var ErrRateLimited = fmt.Errorf("%w: rate limit exceeded", ErrRejected)
+
+// DispatchFunc stores and applies a record, or passes it on to the next middleware.
+type DispatchFunc func(record *Record) error
+
+// Middleware wraps the rest of the dispatch chain. It can inspect or change the record
+// before calling next, veto it by returning an error without calling next, and look at
+// the outcome once next returns. Records reach the store and the handlers only at the
+// end of the chain, so a vetoed event is neither stored nor applied.
+type Middleware func(next DispatchFunc) DispatchFunc
+
+// Validate vetoes events for which check returns an error. The result matches both ErrRejected
+// and the error of check.
+func Validate(check func(event Event) error) Middleware {
+	return func(next DispatchFunc) DispatchFunc {
+		return func(record *Record) error {
+			if err := check(record.Event); err != nil {
+				return fmt.Errorf("%w: invalid %s event: %w", ErrRejected, record.Event.EventType(), err)
+			}
+			return next(record)
+		}
+	}
+}
+
+// Logging logs every dispatched event and its outcome to logger, or to the standard logger if nil.
+func Logging(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(next DispatchFunc) DispatchFunc {
+		return func(record *Record) error {
+			err := next(record)
+			if err != nil {
+				logger.Printf("Event %s #%d failed: %v", record.Event.EventType(), record.Sequence, err)
+			} else {
+				logger.Printf("Event %s #%d dispatched", record.Event.EventType(), record.Sequence)
+			}
+			return err
+		}
+	}
+}
+
+// RateLimit vetoes events of eventType once max of them were dispatched within per,
+// measured by their timestamps. An empty eventType limits all events together.
+func RateLimit(eventType string, max int, per time.Duration) Middleware {
+	var mu sync.Mutex
+	var recent []time.Time // Timestamps of the accepted events within the window
+	return func(next DispatchFunc) DispatchFunc {
+		return func(record *Record) error {
+			if eventType != "" && record.Event.EventType() != eventType {
+				return next(record)
+			}
+			mu.Lock()
+			cutoff := record.Timestamp.Add(-per)
+			for len(recent) > 0 && !recent[0].After(cutoff) {
+				recent = recent[1:]
+			}
+			if len(recent) >= max {
+				mu.Unlock()
+				return ErrRateLimited
+			}
+			recent = append(recent, record.Timestamp)
+			mu.Unlock()
+			return next(record)
+		}
+	}
+}
+
+// EventCounts are the dispatch statistics of one event type.
+type EventCounts struct {
+	Dispatched int           // Events stored and applied
+	Failed     int           // Events vetoed or that failed further down the chain
+	Duration   time.Duration // Total time spent in the rest of the chain
+}
+
+// Metrics counts dispatched events per type.
+// Add its Middleware to a dispatcher and read the counts with Counts.
+type Metrics struct {
+	mu     sync.Mutex
+	counts map[string]EventCounts
+}
+
+// NewMetrics creates an empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{counts: make(map[string]EventCounts)}
+}
+
+// Middleware returns the middleware that updates the counts.
+func (m *Metrics) Middleware() Middleware {
+	return func(next DispatchFunc) DispatchFunc {
+		return func(record *Record) error {
+			start := time.Now()
+			err := next(record)
+			elapsed := time.Since(start)
+
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			counts := m.counts[record.Event.EventType()]
+			if err != nil {
+				counts.Failed++
+			} else {
+				counts.Dispatched++
+			}
+			counts.Duration += elapsed
+			m.counts[record.Event.EventType()] = counts
+			return err
+		}
+	}
+}
+
+// Counts returns the statistics for every event type seen so far.
+func (m *Metrics) Counts() map[string]EventCounts {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := make(map[string]EventCounts, len(m.counts))
+	for eventType, c := range m.counts {
+		counts[eventType] = c
+	}
+	return counts
+}
@@ -0,0 +1,119 @@
+package events
+
+import (
+	stderrors "errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareOrderAndEnrichment(t *testing.T) {
+	store := &sliceStore{}
+	ed := NewEventDispatcher(store)
+
+	var trace []string
+	tracer := func(name string) Middleware {
+		return func(next DispatchFunc) DispatchFunc {
+			return func(record *Record) error {
+				trace = append(trace, name+" before")
+				err := next(record)
+				trace = append(trace, name+" after")
+				return err
+			}
+		}
+	}
+	enrich := func(next DispatchFunc) DispatchFunc {
+		return func(record *Record) error {
+			if click, ok := record.Event.(*ClickEvent); ok && click.PlayerID == "" {
+				click.PlayerID = "player1"
+			}
+			return next(record)
+		}
+	}
+	ed.Use(tracer("outer"), tracer("inner"))
+	ed.Use(enrich)
+
+	var handled *ClickEvent
+	ed.Register("Click", func(event Event) {
+		handled = event.(*ClickEvent)
+		trace = append(trace, "handler")
+	})
+	ed.Dispatch(&ClickEvent{})
+
+	want := "outer before,inner before,handler,inner after,outer after"
+	if got := strings.Join(trace, ","); got != want {
+		t.Errorf("Chain order mismatch: got %s, want %s", got, want)
+	}
+	if handled == nil || handled.PlayerID != "player1" {
+		t.Errorf("Expected the handler to see the enriched event, got %+v", handled)
+	}
+	if len(store.records) != 1 || store.records[0].Event.(*ClickEvent).PlayerID != "player1" {
+		t.Errorf("Expected the enriched event to be stored, got %v", store.records)
+	}
+}
+
+func TestValidateVetoesEvent(t *testing.T) {
+	store := &sliceStore{}
+	ed := NewEventDispatcher(store)
+	metrics := NewMetrics()
+	errNegative := stderrors.New("negative damage")
+	ed.Use(metrics.Middleware(), Validate(func(event Event) error {
+		if click, ok := event.(*ClickEvent); ok && click.DamageDealt < 0 {
+			return errNegative
+		}
+		return nil
+	}))
+	handled := 0
+	ed.Register("Click", func(event Event) { handled++ })
+
+	if err := ed.Dispatch(&ClickEvent{DamageDealt: -1}); !stderrors.Is(err, ErrRejected) || !stderrors.Is(err, errNegative) {
+		t.Errorf("Expected the veto to match ErrRejected and the validator's error, got %v", err)
+	}
+	ed.Dispatch(&ClickEvent{DamageDealt: 1})
+
+	if handled != 1 || len(store.records) != 1 {
+		t.Fatalf("Expected only the valid event to be stored and handled, got %d stored and %d handled", len(store.records), handled)
+	}
+	if store.records[0].Sequence != 1 || ed.LastSequence() != 1 {
+		t.Errorf("Expected the vetoed event not to use a sequence number, got %d", store.records[0].Sequence)
+	}
+	counts := metrics.Counts()["Click"]
+	if counts.Dispatched != 1 || counts.Failed != 1 {
+		t.Errorf("Metrics mismatch: got %+v", counts)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	limit := RateLimit("Click", 2, time.Second)
+	var passed []uint64
+	dispatch := limit(func(record *Record) error {
+		passed = append(passed, record.Sequence)
+		return nil
+	})
+
+	start := time.Now()
+	at := func(sequence uint64, offset time.Duration, event Event) error {
+		return dispatch(&Record{Metadata: Metadata{Sequence: sequence, Timestamp: start.Add(offset)}, Event: event})
+	}
+	for i, step := range []struct {
+		offset time.Duration
+		event  Event
+		err    error
+	}{
+		{0, &ClickEvent{}, nil},
+		{100 * time.Millisecond, &ClickEvent{}, nil},
+		{200 * time.Millisecond, &ClickEvent{}, ErrRateLimited},
+		{300 * time.Millisecond, &HeartTakenEvent{}, nil}, // Other event types are not limited
+		{time.Second, &ClickEvent{}, nil},                 // The first click left the window
+	} {
+		if err := at(uint64(i+1), step.offset, step.event); err != step.err {
+			t.Errorf("Event %d: got error %v, want %v", i+1, err, step.err)
+		}
+	}
+	if !stderrors.Is(ErrRateLimited, ErrRejected) {
+		t.Errorf("Expected ErrRateLimited to match ErrRejected")
+	}
+	if len(passed) != 4 {
+		t.Errorf("Expected 4 events to pass, got %v", passed)
+	}
+}
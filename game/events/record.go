@@ -0,0 +1,53 @@
+package events
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"clicker2/game/errors"
+)
+
+// Metadata describes when and where an event was recorded.
+// It is assigned by the dispatcher and persisted alongside the event.
+type Metadata struct {
+	Sequence  uint64    `json:"seq"`           // Monotonic position in the event log, starting at 1
+	Timestamp time.Time `json:"ts"`            // Wall-clock time of dispatch
+	EventID   string    `json:"id"`            // Globally unique event identifier
+	SessionID string    `json:"session"`       // Identifies the game session that produced the event
+	MAC       string    `json:"mac,omitempty"` // Chains the record to the one before it in a signed log
+}
+
+// Record is an event together with the metadata assigned when it was dispatched.
+type Record struct {
+	Metadata
+	Event Event
+}
+
+// NewID returns a random identifier suitable for events and sessions.
+func NewID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic("events: failed to generate random id: " + err.Error())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// EncodeRecord wraps a record's event and metadata in an envelope.
+func EncodeRecord(record *Record) (*Envelope, error) {
+	env, err := Encode(record.Event)
+	if err != nil {
+		return nil, err
+	}
+	env.Metadata = record.Metadata
+	return env, nil
+}
+
+// DecodeRecord decodes an envelope into a record, upcasting the payload if needed.
+func DecodeRecord(env *Envelope) (*Record, *errors.GameError) {
+	event, err := DecodeEnvelope(env)
+	if err != nil {
+		return nil, err
+	}
+	return &Record{Metadata: env.Metadata, Event: event}, nil
+}
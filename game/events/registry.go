@@ -0,0 +1,57 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"clicker2/game/errors"
+)
+
+// Factory returns a new, zero-valued instance of an event type, ready to be decoded into.
+type Factory func() Event
+
+// registry maps event type names to the factories that create them.
+var registry = make(map[string]Factory)
+
+// RegisterType registers a factory for the given event type name.
+// Every event that is persisted must be registered so stores can decode it.
+// Registering the same name twice panics, as it is always a programming error.
+func RegisterType(eventType string, factory Factory) {
+	if _, exists := registry[eventType]; exists {
+		panic(fmt.Sprintf("events: event type %q registered twice", eventType))
+	}
+	registry[eventType] = factory
+}
+
+// NewEvent returns a zero-valued event of the given type.
+// The second return value is false if the type has not been registered.
+func NewEvent(eventType string) (Event, bool) {
+	factory, ok := registry[eventType]
+	if !ok {
+		return nil, false
+	}
+	return factory(), true
+}
+
+// RegisteredTypes returns the names of all registered event types in sorted order.
+func RegisteredTypes() []string {
+	types := make([]string, 0, len(registry))
+	for eventType := range registry {
+		types = append(types, eventType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Decode creates an event of the given type and unmarshals data into it.
+func Decode(eventType string, data json.RawMessage) (Event, *errors.GameError) {
+	event, ok := NewEvent(eventType)
+	if !ok {
+		return nil, errors.NewGameError(errors.ErrUnknownEventType, fmt.Sprintf("unknown event type: %s", eventType))
+	}
+	if err := json.Unmarshal(data, event); err != nil {
+		return nil, errors.NewGameError(errors.ErrUnknown, fmt.Sprintf("failed to unmarshal %s event: %v", eventType, err))
+	}
+	return event, nil
+}
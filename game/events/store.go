@@ -0,0 +1,51 @@
+package events
+
+import "errors"
+
+// EventStore persists records and streams them back in the order they were appended.
+// Implementations must be safe for concurrent use and report failures as errors that
+// can be inspected with errors.Is and errors.As.
+type EventStore interface {
+	// Append adds a record to the end of the store. It may be buffered until Flush.
+	// A record with the EventID of a recent record in the store, see Dedup, is dropped without an error.
+	Append(record *Record) error
+	// ReadFrom streams records with a sequence number of at least from, in log order, to fn.
+	// Only records appended before the call are read, so fn may append to the store.
+	// Reading stops at the first error returned by fn, which is wrapped in the result;
+	// returning ErrStop ends it without an error.
+	ReadFrom(from uint64, fn func(record *Record) error) error
+	// Flush writes buffered records to the underlying storage.
+	Flush() error
+	// Close flushes pending records and releases the store. Appending afterwards fails with ErrClosed.
+	Close() error
+}
+
+// SequenceReader is implemented by stores that can find the sequence number of their last record
+// without reading every record, see LastSequence.
+type SequenceReader interface {
+	// LastSequence returns the highest sequence number near the end of the store, 0 if it is empty.
+	LastSequence() (uint64, error)
+}
+
+// LastSequence returns the sequence number new records appended to es should follow: the highest
+// sequence number in es, or 0 if it is empty. Stores that do not implement SequenceReader are read
+// from the first record.
+func LastSequence(es EventStore) (uint64, error) {
+	if sr, ok := es.(SequenceReader); ok {
+		return sr.LastSequence()
+	}
+	var last uint64
+	err := es.ReadFrom(0, func(record *Record) error {
+		if record.Sequence > last {
+			last = record.Sequence
+		}
+		return nil
+	})
+	return last, err
+}
+
+// ErrStop can be returned by a ReadFrom callback to stop reading early.
+var ErrStop = errors.New("events: stop reading")
+
+// ErrClosed is returned when appending to a store, or dispatching with a dispatcher, that has been closed.
+var ErrClosed = errors.New("events: closed")
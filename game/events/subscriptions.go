@@ -0,0 +1,86 @@
+package events
+
+import "strings"
+
+// Filter selects the records a subscriber receives.
+type Filter func(record *Record) bool
+
+// AllEvents selects every record.
+func AllEvents() Filter {
+	return func(record *Record) bool { return true }
+}
+
+// OfType selects records of the given event types.
+func OfType(eventTypes ...string) Filter {
+	if len(eventTypes) == 1 { // The common case, used by Register
+		eventType := eventTypes[0]
+		return func(record *Record) bool { return record.Event.EventType() == eventType }
+	}
+	return func(record *Record) bool {
+		for _, eventType := range eventTypes {
+			if record.Event.EventType() == eventType {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// WithPrefix selects records whose event type starts with prefix, e.g. "Click" for both
+// Click and ClicksAggregated events.
+func WithPrefix(prefix string) Filter {
+	return func(record *Record) bool { return strings.HasPrefix(record.Event.EventType(), prefix) }
+}
+
+// Token identifies a subscription so it can be removed with Unsubscribe.
+type Token uint64
+
+// subscription is a synchronous handler with the filter that selects its records.
+type subscription struct {
+	token   Token
+	filter  Filter
+	handler RecordHandler
+}
+
+// Subscribe registers a handler for the records selected by filter and returns the token
+// to unsubscribe it. Handlers run in the order they were subscribed, whatever their filters,
+// and each sees a record only after the handlers subscribed before it have accepted it.
+// A handler that subscribes or unsubscribes others during dispatch changes who receives the next record.
+func (ed *EventDispatcher) Subscribe(filter Filter, handler RecordHandler) Token {
+	ed.mu.Lock()
+	defer ed.mu.Unlock()
+	ed.lastToken++
+	// Copy on write, so a dispatch in progress keeps iterating the handlers it started with.
+	subscriptions := make([]subscription, len(ed.subscriptions), len(ed.subscriptions)+1)
+	copy(subscriptions, ed.subscriptions)
+	ed.subscriptions = append(subscriptions, subscription{token: ed.lastToken, filter: filter, handler: handler})
+	return ed.lastToken
+}
+
+// Unsubscribe removes the handler or asynchronous subscriber registered under token.
+// An asynchronous subscriber first handles the events already queued for it.
+// It reports whether the token was subscribed.
+func (ed *EventDispatcher) Unsubscribe(token Token) bool {
+	ed.mu.Lock()
+	for i, s := range ed.subscriptions {
+		if s.token == token {
+			subscriptions := make([]subscription, 0, len(ed.subscriptions)-1)
+			subscriptions = append(subscriptions, ed.subscriptions[:i]...)
+			ed.subscriptions = append(subscriptions, ed.subscriptions[i+1:]...)
+			ed.mu.Unlock()
+			return true
+		}
+	}
+	for i, s := range ed.async {
+		if s.token == token {
+			async := make([]*Subscription, 0, len(ed.async)-1)
+			async = append(async, ed.async[:i]...)
+			ed.async = append(async, ed.async[i+1:]...)
+			ed.mu.Unlock()
+			s.close()
+			return true
+		}
+	}
+	ed.mu.Unlock()
+	return false
+}
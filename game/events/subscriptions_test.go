@@ -0,0 +1,87 @@
+package events
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSubscribeFiltersAndOrder(t *testing.T) {
+	ed := NewEventDispatcher(nil)
+	var trace []string
+	subscribe := func(name string, filter Filter) Token {
+		return ed.Subscribe(filter, func(record *Record) error {
+			trace = append(trace, name+":"+record.Event.EventType())
+			return nil
+		})
+	}
+	subscribe("all", AllEvents())
+	ed.Register("Click", func(event Event) { trace = append(trace, "exact:Click") })
+	subscribe("prefix", WithPrefix("Click"))
+	big := subscribe("predicate", func(record *Record) bool {
+		click, ok := record.Event.(*ClickEvent)
+		return ok && click.DamageDealt > 10
+	})
+
+	ed.Dispatch(&ClickEvent{DamageDealt: 20})
+	ed.Dispatch(&ClicksAggregatedEvent{})
+	ed.Dispatch(&HeartTakenEvent{})
+	want := "all:Click,exact:Click,prefix:Click,predicate:Click," +
+		"all:ClicksAggregated,prefix:ClicksAggregated," +
+		"all:HeartTaken"
+	if got := strings.Join(trace, ","); got != want {
+		t.Errorf("Handler order mismatch:\ngot  %s\nwant %s", got, want)
+	}
+
+	trace = nil
+	if !ed.Unsubscribe(big) || ed.Unsubscribe(big) {
+		t.Errorf("Expected the first Unsubscribe to succeed and the second to fail")
+	}
+	ed.Dispatch(&ClickEvent{DamageDealt: 20})
+	if got := strings.Join(trace, ","); got != "all:Click,exact:Click,prefix:Click" {
+		t.Errorf("Unsubscribed handler still called: %s", got)
+	}
+}
+
+func TestUnsubscribeDuringDispatch(t *testing.T) {
+	ed := NewEventDispatcher(nil)
+	calls := 0
+	var once Token
+	once = ed.Subscribe(AllEvents(), func(record *Record) error {
+		calls++
+		ed.Unsubscribe(once)
+		return nil
+	})
+	later := 0
+	ed.Subscribe(AllEvents(), func(record *Record) error {
+		later++
+		return nil
+	})
+
+	ed.Dispatch(&ClickEvent{})
+	ed.Dispatch(&ClickEvent{})
+	if calls != 1 || later != 2 {
+		t.Errorf("Expected the self-removing handler once and the next one twice, got %d and %d", calls, later)
+	}
+}
+
+func TestUnsubscribeAsync(t *testing.T) {
+	ed := NewEventDispatcher(nil)
+	got := 0
+	s := ed.SubscribeAsync(AllEvents(), func(record *Record) error {
+		got++
+		return nil
+	}, AsyncOptions{})
+	ed.Dispatch(&ClickEvent{})
+	ed.Dispatch(&ClickEvent{})
+	if !ed.Unsubscribe(s.Token()) {
+		t.Fatalf("Unsubscribe of the async subscriber failed")
+	}
+	if got != 2 {
+		t.Errorf("Expected the queued events to be handled before Unsubscribe returned, got %d", got)
+	}
+	ed.Dispatch(&ClickEvent{})
+	ed.Close()
+	if got != 2 {
+		t.Errorf("Unsubscribed async subscriber still received events, got %d", got)
+	}
+}
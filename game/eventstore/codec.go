@@ -0,0 +1,451 @@
+package eventstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"clicker2/game/events"
+)
+
+// Format selects how a FileEventStore encodes records on disk.
+type Format int
+
+const (
+	// FormatJSON writes one JSON object per line. It is easy to inspect and edit by hand.
+	FormatJSON Format = iota
+	// FormatBinary writes length-prefixed binary frames. It is smaller and faster to read.
+	FormatBinary
+)
+
+// String returns the name of the format as accepted by ParseFormat.
+func (f Format) String() string {
+	switch f {
+	case FormatJSON:
+		return "json"
+	case FormatBinary:
+		return "binary"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// ParseFormat returns the format with the given name, "json" or "binary".
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "json":
+		return FormatJSON, nil
+	case "binary":
+		return FormatBinary, nil
+	}
+	return 0, fmt.Errorf("unknown event log format %q", name)
+}
+
+// errCorruptRecord marks a record that could not be decoded, as opposed to a failed read.
+var errCorruptRecord = stderrors.New("corrupt record")
+
+// recordCodec reads and writes records in one on-disk format.
+type recordCodec interface {
+	format() Format
+	// header is written at the start of every file in this format.
+	header() []byte
+	// encode serializes a record, including any framing and checksum.
+	encode(record *events.Record) ([]byte, error)
+	// next reads the next record from r and returns it with the number of bytes consumed.
+	// It returns io.EOF at the end of the input and an error wrapping errCorruptRecord
+	// if the bytes consumed are not a valid record.
+	next(r *bufio.Reader) (*events.Envelope, int, error)
+}
+
+func codecFor(format Format) recordCodec {
+	if format == FormatBinary {
+		return binaryCodec{}
+	}
+	return jsonCodec{}
+}
+
+// detectFormat returns the format of an event log file from its header.
+// Empty and missing files have no format yet and report ok as false.
+func detectFormat(path string) (format Format, ok bool, err error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+	head := make([]byte, len(binaryMagic))
+	n, err := io.ReadFull(file, head)
+	if n == 0 {
+		return 0, false, nil
+	}
+	if err == nil && bytes.Equal(head, binaryMagic) {
+		return FormatBinary, true, nil
+	}
+	return FormatJSON, true, nil
+}
+
+// jsonCodec reads and writes JSON lines ending in a checksum, see addChecksum.
+type jsonCodec struct{}
+
+func (jsonCodec) format() Format { return FormatJSON }
+
+func (jsonCodec) header() []byte { return nil }
+
+func (jsonCodec) encode(record *events.Record) ([]byte, error) {
+	// Wrap the event with its type, schema version and metadata for deserialization
+	eventWrapper, err := events.EncodeRecord(record)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedData, err := json.Marshal(eventWrapper)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event wrapper: %w", err)
+	}
+	return addChecksum(wrappedData), nil
+}
+
+func (jsonCodec) next(r *bufio.Reader) (*events.Envelope, int, error) {
+	consumed := 0
+	for {
+		line, err := r.ReadBytes('\n')
+		consumed += len(line)
+		if err != nil && err != io.EOF {
+			return nil, consumed, err
+		}
+		if content := bytes.TrimRight(line, "\n"); len(content) > 0 {
+			env, decodeErr := decodeLine(content)
+			if decodeErr != nil {
+				return nil, consumed, fmt.Errorf("%w: %v", errCorruptRecord, decodeErr)
+			}
+			return env, consumed, nil
+		}
+		if err == io.EOF {
+			return nil, consumed, io.EOF
+		}
+	}
+}
+
+// binaryMagic starts every binary event log file.
+var binaryMagic = []byte("CLKEVT\x00\x01")
+
+// maxFrameSize bounds the length prefix of a binary frame, so a damaged prefix is not mistaken for a huge record.
+const maxFrameSize = 1 << 24
+
+// binaryCodec reads and writes frames of a uvarint body length, the body and a little-endian CRC-32 of the body.
+// The body holds the metadata, event type and version followed by the event payload, whose fields are
+// stored in order with a type tag so the original JSON payload can be rebuilt exactly.
+type binaryCodec struct{}
+
+// Type tags of payload values in the binary format.
+const (
+	tagNull byte = iota
+	tagFalse
+	tagTrue
+	tagInt    // varint
+	tagNumber // number that does not fit an int64, kept as text
+	tagString
+	tagObject // uvarint field count, then key and value of each field
+	tagArray  // uvarint element count, then each value
+)
+
+func (binaryCodec) format() Format { return FormatBinary }
+
+func (binaryCodec) header() []byte { return binaryMagic }
+
+func (binaryCodec) encode(record *events.Record) ([]byte, error) {
+	env, err := events.EncodeRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	return encodeFrame(env)
+}
+
+// encodeFrame serializes an envelope as a binary frame.
+func encodeFrame(env *events.Envelope) ([]byte, error) {
+	var body []byte
+	body = binary.AppendUvarint(body, env.Sequence)
+	body = binary.AppendVarint(body, env.Timestamp.Unix())
+	body = binary.AppendUvarint(body, uint64(env.Timestamp.Nanosecond()))
+	_, offset := env.Timestamp.Zone()
+	body = binary.AppendVarint(body, int64(offset))
+	body = appendString(body, env.EventID)
+	body = appendString(body, env.SessionID)
+	body = appendString(body, env.Type)
+	body = binary.AppendUvarint(body, uint64(env.Version))
+
+	dec := json.NewDecoder(bytes.NewReader(env.Data))
+	dec.UseNumber()
+	body, err := appendValue(body, dec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s payload: %w", env.Type, err)
+	}
+	if env.MAC != "" { // Optional trailer, so unsigned frames keep their layout
+		body = appendString(body, env.MAC)
+	}
+
+	frame := binary.AppendUvarint(make([]byte, 0, len(body)+binary.MaxVarintLen64+4), uint64(len(body)))
+	frame = append(frame, body...)
+	return binary.LittleEndian.AppendUint32(frame, crc32.ChecksumIEEE(body)), nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// appendValue encodes the next JSON value read from dec.
+func appendValue(b []byte, dec *json.Decoder) ([]byte, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch v := token.(type) {
+	case nil:
+		return append(b, tagNull), nil
+	case bool:
+		if v {
+			return append(b, tagTrue), nil
+		}
+		return append(b, tagFalse), nil
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil && strconv.FormatInt(i, 10) == string(v) {
+			return binary.AppendVarint(append(b, tagInt), i), nil
+		}
+		return appendString(append(b, tagNumber), string(v)), nil
+	case string:
+		return appendString(append(b, tagString), v), nil
+	case json.Delim:
+		var values []byte
+		count := 0
+		for dec.More() {
+			if v == '{' {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				values = appendString(values, key.(string))
+			}
+			if values, err = appendValue(values, dec); err != nil {
+				return nil, err
+			}
+			count++
+		}
+		if _, err := dec.Token(); err != nil { // Closing delimiter
+			return nil, err
+		}
+		tag := tagArray
+		if v == '{' {
+			tag = tagObject
+		}
+		b = binary.AppendUvarint(append(b, tag), uint64(count))
+		return append(b, values...), nil
+	}
+	return nil, fmt.Errorf("unexpected JSON token %v", token)
+}
+
+func (binaryCodec) next(r *bufio.Reader) (*events.Envelope, int, error) {
+	var length uint64
+	consumed := 0
+	for shift := uint(0); ; shift += 7 {
+		c, err := r.ReadByte()
+		if err == io.EOF && consumed == 0 {
+			return nil, 0, io.EOF
+		}
+		if err == io.EOF {
+			return nil, consumed, fmt.Errorf("%w: truncated length", errCorruptRecord)
+		}
+		if err != nil {
+			return nil, consumed, err
+		}
+		consumed++
+		if consumed > binary.MaxVarintLen64 {
+			return nil, consumed, fmt.Errorf("%w: malformed length", errCorruptRecord)
+		}
+		length |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			break
+		}
+	}
+	if length > maxFrameSize {
+		return nil, consumed, fmt.Errorf("%w: frame of %d bytes is too large", errCorruptRecord, length)
+	}
+
+	frame := make([]byte, length+4)
+	n, err := io.ReadFull(r, frame)
+	consumed += n
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, consumed, fmt.Errorf("%w: truncated frame", errCorruptRecord)
+	}
+	if err != nil {
+		return nil, consumed, err
+	}
+	body := frame[:length]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(frame[length:]) {
+		return nil, consumed, fmt.Errorf("%w: checksum mismatch", errCorruptRecord)
+	}
+	env, err := decodeFrameBody(body)
+	if err != nil {
+		return nil, consumed, fmt.Errorf("%w: %v", errCorruptRecord, err)
+	}
+	return env, consumed, nil
+}
+
+// frameReader decodes the fields of a frame body.
+type frameReader struct {
+	b   []byte
+	err error
+}
+
+func (fr *frameReader) uvarint() uint64 {
+	v, n := binary.Uvarint(fr.b)
+	if n <= 0 {
+		fr.fail()
+		return 0
+	}
+	fr.b = fr.b[n:]
+	return v
+}
+
+func (fr *frameReader) varint() int64 {
+	v, n := binary.Varint(fr.b)
+	if n <= 0 {
+		fr.fail()
+		return 0
+	}
+	fr.b = fr.b[n:]
+	return v
+}
+
+func (fr *frameReader) string() string {
+	n := fr.uvarint()
+	if n > uint64(len(fr.b)) {
+		fr.fail()
+		return ""
+	}
+	s := string(fr.b[:n])
+	fr.b = fr.b[n:]
+	return s
+}
+
+func (fr *frameReader) byte() byte {
+	if len(fr.b) == 0 {
+		fr.fail()
+		return 0
+	}
+	c := fr.b[0]
+	fr.b = fr.b[1:]
+	return c
+}
+
+func (fr *frameReader) fail() {
+	if fr.err == nil {
+		fr.err = stderrors.New("truncated frame body")
+	}
+	fr.b = nil
+}
+
+// decodeFrameBody rebuilds the envelope, and its JSON payload, from a frame body.
+func decodeFrameBody(body []byte) (*events.Envelope, error) {
+	fr := &frameReader{b: body}
+	env := &events.Envelope{}
+	env.Sequence = fr.uvarint()
+	sec, nsec, offset := fr.varint(), fr.uvarint(), fr.varint()
+	env.Timestamp = inZone(time.Unix(sec, int64(nsec)), int(offset))
+	env.EventID = fr.string()
+	env.SessionID = fr.string()
+	env.Type = fr.string()
+	env.Version = int(fr.uvarint())
+
+	var data bytes.Buffer
+	decodeValue(fr, &data)
+	if len(fr.b) != 0 {
+		env.MAC = fr.string()
+	}
+	if fr.err != nil {
+		return nil, fr.err
+	}
+	if len(fr.b) != 0 {
+		return nil, fmt.Errorf("%d unexpected bytes after payload", len(fr.b))
+	}
+	env.Data = data.Bytes()
+	return env, nil
+}
+
+// inZone places t in the zone it was recorded in, given that zone's UTC offset.
+// Like time.Time's JSON decoding it prefers UTC and the local zone over a fixed zone.
+func inZone(t time.Time, offset int) time.Time {
+	if offset == 0 {
+		return t.UTC()
+	}
+	if _, local := t.Local().Zone(); local == offset {
+		return t.Local()
+	}
+	return t.In(time.FixedZone("", offset))
+}
+
+// decodeValue writes the next payload value of fr to w as JSON.
+func decodeValue(fr *frameReader, w *bytes.Buffer) {
+	switch tag := fr.byte(); tag {
+	case tagNull:
+		w.WriteString("null")
+	case tagFalse:
+		w.WriteString("false")
+	case tagTrue:
+		w.WriteString("true")
+	case tagInt:
+		w.WriteString(strconv.FormatInt(fr.varint(), 10))
+	case tagNumber:
+		w.WriteString(fr.string())
+	case tagString:
+		quoted, _ := json.Marshal(fr.string())
+		w.Write(quoted)
+	case tagObject, tagArray:
+		open, close := byte('['), byte(']')
+		if tag == tagObject {
+			open, close = '{', '}'
+		}
+		w.WriteByte(open)
+		count := fr.uvarint()
+		for i := uint64(0); i < count && fr.err == nil; i++ {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			if tag == tagObject {
+				key, _ := json.Marshal(fr.string())
+				w.Write(key)
+				w.WriteByte(':')
+			}
+			decodeValue(fr, w)
+		}
+		w.WriteByte(close)
+	default:
+		if fr.err == nil {
+			fr.err = fmt.Errorf("unknown value tag %d", tag)
+		}
+	}
+}
+
+// Convert appends every record of src to dst and returns the number of records copied.
+// Combined with a FileEventStore using the other Format it converts a log between the
+// JSON and binary encodings; metadata and payloads are carried over unchanged.
+func Convert(src, dst events.EventStore) (int, error) {
+	copied := 0
+	gerr := src.ReadFrom(0, func(record *events.Record) error {
+		if err := dst.Append(record); err != nil {
+			return err
+		}
+		copied++
+		return nil
+	})
+	return copied, gerr
+}
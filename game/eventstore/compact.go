@@ -0,0 +1,303 @@
+package eventstore
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"clicker2/game/events"
+)
+
+// CompactionStats describes the result of a compaction pass.
+type CompactionStats struct {
+	RecordsIn    int
+	RecordsOut   int
+	ArchivePaths []string // Where the original files were moved, empty if they were discarded
+}
+
+// Compactor merges runs of consecutive click records into ClicksAggregated records.
+// Records are fed in log order with Add; compacted records are passed to emit.
+// A run is broken by any other event, a change of session or a gap in the rock health or dust.
+type Compactor struct {
+	emit  func(record *events.Record) error
+	first *events.Record // First record of the pending run
+	last  *events.Record // Last record of the pending run
+	agg   *events.ClicksAggregatedEvent
+	parts int // Number of records merged into the pending run
+}
+
+// NewCompactor creates a Compactor that passes compacted records to emit.
+func NewCompactor(emit func(record *events.Record) error) *Compactor {
+	return &Compactor{emit: emit}
+}
+
+// Add feeds the next record of the log to the compactor.
+func (c *Compactor) Add(record *events.Record) error {
+	agg := asAggregate(record)
+	if agg == nil {
+		if err := c.Flush(); err != nil {
+			return err
+		}
+		return c.emit(record)
+	}
+
+	if c.agg != nil && c.last.SessionID == record.SessionID &&
+		c.agg.RockHealthAfter == agg.RockHealthBefore && c.agg.PlayerDustAfter == agg.PlayerDustBefore {
+		c.agg.Clicks += agg.Clicks
+		c.agg.TotalDamage += agg.TotalDamage
+		c.agg.TotalDust += agg.TotalDust
+		c.agg.RockHealthAfter = agg.RockHealthAfter
+		c.agg.PlayerDustAfter = agg.PlayerDustAfter
+		c.last = record
+		c.parts++
+		return nil
+	}
+
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	c.first, c.last, c.agg, c.parts = record, record, agg, 1
+	return nil
+}
+
+// Flush emits the pending run, if any. It must be called after the last record was added.
+func (c *Compactor) Flush() error {
+	if c.agg == nil {
+		return nil
+	}
+	record := c.first
+	if c.parts > 1 {
+		// The aggregate takes the place of the last click, so sequence numbers stay monotonic.
+		// Its ID is derived from the run it replaces, so compacting the same log twice yields the same ID.
+		sum := sha256.Sum256([]byte(c.first.EventID + ":" + c.last.EventID))
+		record = &events.Record{
+			Metadata: events.Metadata{
+				Sequence:  c.last.Sequence,
+				Timestamp: c.last.Timestamp,
+				EventID:   hex.EncodeToString(sum[:16]),
+				SessionID: c.last.SessionID,
+			},
+			Event: c.agg,
+		}
+	}
+	c.first, c.last, c.agg, c.parts = nil, nil, nil, 0
+	return c.emit(record)
+}
+
+// asAggregate returns a click or aggregate record as a fresh aggregate, or nil for any other event.
+func asAggregate(record *events.Record) *events.ClicksAggregatedEvent {
+	switch e := record.Event.(type) {
+	case *events.ClickEvent:
+		return &events.ClicksAggregatedEvent{
+			PlayerID:         e.PlayerID,
+			Clicks:           1,
+			FirstSequence:    record.Sequence,
+			TotalDamage:      e.DamageDealt,
+			TotalDust:        e.DustGained,
+			RockHealthBefore: e.RockHealthBefore,
+			RockHealthAfter:  e.RockHealthAfter,
+			PlayerDustBefore: e.PlayerDustBefore,
+			PlayerDustAfter:  e.PlayerDustAfter,
+		}
+	case *events.ClicksAggregatedEvent:
+		agg := *e
+		return &agg
+	}
+	return nil
+}
+
+// Compact rewrites the log with runs of clicks collapsed into ClicksAggregated events.
+// It is safe to call while the store is in use; appends wait until it is done.
+// If archive is true the original log is kept next to the compacted one, otherwise it is removed.
+// A segmented log is compacted one segment at a time, the active one included; the append
+// handle is released first and the next append reopens the compacted active segment.
+// With FileStoreOptions.CompactSealed, segments are also compacted as soon as they are sealed.
+func (fs *FileEventStore) Compact(archive bool) (*CompactionStats, error) {
+	fs.compactMu.Lock()
+	defer fs.compactMu.Unlock()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// The active file is about to be replaced, so release the append handle.
+	if err := fs.closeWriterLocked(); err != nil {
+		return nil, err
+	}
+	if gerr := fs.recoverLocked(); gerr != nil {
+		return nil, gerr
+	}
+	segments, err := fs.segments()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list event log segments: %w", err)
+	}
+	stats := &CompactionStats{}
+	if !fs.segmented() {
+		if _, gerr := fs.compactFileLocked(segments[0], archive, stats); gerr != nil {
+			return nil, gerr
+		}
+		return stats, nil
+	}
+
+	entries, err := fs.readIndex()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read event log index: %w", err)
+	}
+	for _, s := range segments {
+		compacted, gerr := fs.compactFileLocked(s, archive, stats)
+		if gerr != nil {
+			return nil, gerr
+		}
+		entries = replaceIndexEntries(entries, s.number, compacted)
+	}
+	if err := fs.writeIndex(entries); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// compactSealed compacts a segment that was just sealed, discarding the original. Only renaming
+// the compacted segment into place and updating the index take fs.mu, so appends go on while the
+// segment is rewritten. A failure is returned by the next Flush or Close.
+func (fs *FileEventStore) compactSealed(s segment) {
+	defer fs.compacting.Done()
+	fs.compactMu.Lock()
+	defer fs.compactMu.Unlock()
+
+	err := func() error {
+		tmp, compacted, gerr := fs.writeCompacted(s, &CompactionStats{})
+		defer os.Remove(tmp) // No-op once the compacted segment has been moved into place
+		if gerr != nil {
+			return gerr
+		}
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		entries, err := fs.readIndex()
+		if err != nil {
+			return fmt.Errorf("failed to read event log index: %w", err)
+		}
+		if err := os.Rename(tmp, s.path); err != nil {
+			return fmt.Errorf("failed to replace event log: %w", err)
+		}
+		return fs.writeIndex(replaceIndexEntries(entries, s.number, compacted))
+	}()
+	if err != nil {
+		fs.mu.Lock()
+		if fs.compactErr == nil {
+			fs.compactErr = fmt.Errorf("failed to compact %s: %w", s.path, err)
+		}
+		fs.mu.Unlock()
+	}
+}
+
+// replaceIndexEntries replaces the index entries of a segment with those of its compacted version,
+// since its offsets changed, and returns the entries in log order.
+func replaceIndexEntries(entries []indexEntry, number int, compacted []indexEntry) []indexEntry {
+	kept := compacted
+	for _, entry := range entries {
+		if entry.Segment != number {
+			kept = append(kept, entry)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		if kept[i].Segment != kept[j].Segment {
+			return kept[i].Segment < kept[j].Segment
+		}
+		return kept[i].Offset < kept[j].Offset
+	})
+	return kept
+}
+
+// compactFileLocked compacts one file of the log in place, adding to stats,
+// and returns index entries for the compacted file. The caller must hold fs.mu
+// and make sure the file is not being appended to.
+func (fs *FileEventStore) compactFileLocked(s segment, archive bool, stats *CompactionStats) ([]indexEntry, error) {
+	tmp, entries, gerr := fs.writeCompacted(s, stats)
+	defer os.Remove(tmp) // No-op once the compacted log has been moved into place
+	if gerr != nil || tmp == "" {
+		return nil, gerr
+	}
+
+	if archive {
+		archivePath := fmt.Sprintf("%s.archive-%d", s.path, time.Now().UnixNano())
+		if err := os.Rename(s.path, archivePath); err != nil {
+			return nil, fmt.Errorf("failed to archive event log: %w", err)
+		}
+		stats.ArchivePaths = append(stats.ArchivePaths, archivePath)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return nil, fmt.Errorf("failed to replace event log: %w", err)
+	}
+	return entries, nil
+}
+
+// writeCompacted writes the compacted version of a file of the log next to it, adding to stats,
+// and returns its path and index entries. The path is empty if the file does not exist.
+// The file must not be appended to while it is read.
+func (fs *FileEventStore) writeCompacted(s segment, stats *CompactionStats) (string, []indexEntry, error) {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to stat event store file: %w", err)
+	}
+
+	// The compacted file keeps the format of the original.
+	format, _, err := detectFormat(s.path)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read event store file: %w", err)
+	}
+	codec := codecFor(format)
+
+	tmp := s.path + ".compact"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create compacted event log: %w", err)
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+	w.Write(codec.header()) // Errors are sticky and reported by the final flush
+
+	var entries []indexEntry
+	offset := int64(len(codec.header()))
+	written := 0
+	compactor := NewCompactor(func(record *events.Record) error {
+		line, err := codec.encode(record)
+		if err != nil {
+			return err
+		}
+		if written%fs.indexEvery() == 0 {
+			entries = append(entries, indexEntry{Sequence: record.Sequence, Segment: s.number, Offset: offset})
+		}
+		written++
+		stats.RecordsOut++
+		offset += int64(len(line))
+		_, err = w.Write(line)
+		return err
+	})
+	var lastSequence uint64
+	_, gerr := readSegment(segmentRange{path: s.path, size: info.Size()}, 0, &lastSequence, func(record *events.Record) error {
+		if record.MAC != "" {
+			// Aggregates carry no MAC and would break the chain of a SignedEventStore
+			return fmt.Errorf("%s is signed and cannot be compacted", s.path)
+		}
+		stats.RecordsIn++
+		return compactor.Add(record)
+	})
+	if gerr != nil {
+		return tmp, nil, gerr
+	}
+	if err := compactor.Flush(); err != nil {
+		return tmp, nil, fmt.Errorf("failed to compact event log: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return tmp, nil, fmt.Errorf("failed to write compacted event log: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return tmp, nil, fmt.Errorf("failed to write compacted event log: %w", err)
+	}
+	return tmp, entries, nil
+}
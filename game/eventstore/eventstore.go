@@ -2,128 +2,308 @@ package eventstore
 
 import (
 	"bufio"
-	"encoding/json"
+	stderrors "errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"sync"
+	"time"
 
-	"clicker2/game/events"
 	"clicker2/game/errors" // Import the new errors package
+	"clicker2/game/events"
 )
 
-// EventStore defines the interface for storing and loading events.
-type EventStore interface {
-	SaveEvent(event events.Event) error
-	LoadEvents() ([]events.Event, *errors.GameError)
+// ErrCorrupt matches, with errors.Is, the error returned for an event log that cannot be decoded.
+var ErrCorrupt = errors.NewGameError(errors.ErrCorruptEventLog)
+
+// LoadRecords reads every record in the store into memory.
+// Prefer ReadFrom for large logs.
+func LoadRecords(es events.EventStore) ([]*events.Record, error) {
+	var records []*events.Record
+	err := es.ReadFrom(0, func(record *events.Record) error {
+		records = append(records, record)
+		return nil
+	})
+	return records, err
+}
+
+// FileStoreOptions configures buffering, durability and crash recovery of a FileEventStore.
+type FileStoreOptions struct {
+	Sync     SyncPolicy
+	Recovery RecoveryMode
+	// Records are buffered in memory and written to the file once FlushEvery records
+	// are pending or FlushInterval has passed, whichever comes first. A FlushEvery of
+	// zero or one writes every record immediately; a zero FlushInterval disables the timer.
+	FlushEvery    int
+	FlushInterval time.Duration
+	// SegmentSize splits the log into files of about that many bytes, see FileEventStore.
+	// Zero keeps the whole log in a single file.
+	SegmentSize int64
+	// IndexEvery is the number of records between two index entries of a segmented log,
+	// DefaultIndexEvery if zero.
+	IndexEvery int
+	// Format is the encoding of new log files. Existing files are read in whatever format
+	// they were written in, but appending to a file in another format fails; see Convert.
+	Format Format
+	// FollowInterval is how often Follow checks the log for new records, DefaultFollowInterval if zero.
+	FollowInterval time.Duration
+	// DedupWindow is the number of recent event IDs Append checks for duplicates, see events.Dedup;
+	// events.DefaultDedupWindow if zero. A negative window checks every ID in the log, which the
+	// first append then reads whole and keeps in memory.
+	DedupWindow int
+	// CompactSealed compacts every segment in the background once it is sealed, discarding the
+	// original, so a long-running game keeps its log small; see Compact.
+	CompactSealed bool
+}
+
+// DefaultSegmentSize is the size of the segments of a log written with DefaultFileStoreOptions.
+const DefaultSegmentSize = 16 << 20
+
+// DefaultFileStoreOptions flushes a few times a second, syncs at most once a second, quarantines
+// corrupt tails and splits the log into segments of DefaultSegmentSize bytes.
+var DefaultFileStoreOptions = FileStoreOptions{
+	Sync:          SyncPolicy{Mode: SyncInterval, Interval: time.Second},
+	Recovery:      RecoverQuarantine,
+	FlushEvery:    256,
+	FlushInterval: 250 * time.Millisecond,
+	SegmentSize:   DefaultSegmentSize,
 }
 
-// FileEventStore implements EventStore for file-based persistence.
+// FileEventStore implements events.EventStore for file-based persistence.
+// Every record is written as one JSON line carrying a checksum, or as a binary frame
+// with FormatBinary. When the store is
+// first opened for appending, a corrupt tail left by a crash mid-write is removed, see Recover.
+// The file stays open between appends; call Close to flush and release it.
+//
+// With a SegmentSize the log at "events.log" is written as "events-000001.log",
+// "events-000002.log" and so on, starting a new segment once the active one is full.
+// The index "events.idx" maps sequence numbers to a segment and byte offset so readers
+// can seek to a record instead of scanning the whole log.
 type FileEventStore struct {
 	filePath string
+	opts     FileStoreOptions
 	mu       sync.Mutex // Protects file writes
+
+	recovered bool            // Whether the log was checked for a corrupt tail
+	recovery  *RecoveryReport // What that check removed, if anything
+	ids       *events.Dedup   // Event IDs of the last records of the log, nil until the first append
+
+	active     segment // Segment being appended to, the log file itself without segmentation
+	activeSize int64   // Bytes written or buffered in the active segment
+	sinceIndex int     // Records appended since the last index entry
+
+	file     *os.File      // Open for appending, nil until the first append
+	writer   *bufio.Writer // Buffers records in front of file
+	pending  int           // Records buffered since the last flush
+	unsynced int           // Records flushed or buffered since the last sync
+	lastSync time.Time
+	stop     chan struct{} // Closed to stop the flush timer
+	flushErr error         // Error of a flush by the timer, returned by the next Append or Flush
+	closed   bool
+
+	compactMu  sync.Mutex     // Serializes compactions, taken before mu
+	compacting sync.WaitGroup // Background compactions of sealed segments, see CompactSealed
+	compactErr error          // Error of a background compaction, returned by the next Flush or Close
 }
 
-// NewFileEventStore creates a new FileEventStore.
+// NewFileEventStore creates a new FileEventStore with DefaultFileStoreOptions.
 func NewFileEventStore(filePath string) *FileEventStore {
+	return NewFileEventStoreWithOptions(filePath, DefaultFileStoreOptions)
+}
+
+// NewFileEventStoreWithOptions creates a new FileEventStore with the given options.
+func NewFileEventStoreWithOptions(filePath string, opts FileStoreOptions) *FileEventStore {
 	return &FileEventStore{
 		filePath: filePath,
+		opts:     opts,
+		lastSync: time.Now(),
 	}
 }
 
-// SaveEvent serializes an event and appends it to the file.
-func (fs *FileEventStore) SaveEvent(event events.Event) error {
+// Append serializes a record and appends it to the file, unless one of the last DedupWindow
+// records of the log has its event ID; the first append reads them to learn their IDs.
+// The record is buffered and reaches the file on the next flush, see FileStoreOptions.
+func (fs *FileEventStore) Append(record *events.Record) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	file, err := os.OpenFile(fs.filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err := fs.takeFlushErrLocked(); err != nil {
+		return err
+	}
+	if err := fs.openWriterLocked(); err != nil {
+		return err
+	}
+	if err := fs.loadIDsLocked(); err != nil {
+		return err
+	}
+	if fs.ids.Duplicate(record) {
+		return nil
+	}
+
+	line, err := codecFor(fs.opts.Format).encode(record)
 	if err != nil {
-		return fmt.Errorf("failed to open event store file: %w", err)
+		return err
+	}
+	if fs.segmented() {
+		if err := fs.prepareAppendLocked(record.Sequence, int64(len(line))); err != nil {
+			return err
+		}
 	}
-	defer file.Close()
 
-	// Wrap the event with its type for deserialization
-	eventWrapper := struct {
-		Type string        `json:"type"`
-		Data json.RawMessage `json:"data"`
-	}{
-		Type: event.EventType(),
+	if _, err := fs.writer.Write(line); err != nil {
+		return fmt.Errorf("failed to write event to file: %w", err)
 	}
+	fs.ids.Add(record)
+	fs.activeSize += int64(len(line))
+	fs.pending++
+	fs.unsynced++
 
-	data, err := json.Marshal(event)
-	if err != nil {
-		return fmt.Errorf("failed to marshal event: %w", err)
+	if fs.syncDueLocked() {
+		return fs.syncLocked()
+	}
+	if fs.pending >= fs.opts.FlushEvery {
+		return fs.flushLocked()
 	}
-	eventWrapper.Data = data
+	return nil
+}
 
-	wrappedData, err := json.Marshal(eventWrapper)
+// loadIDsLocked reads the event IDs of the last records of the log on first use,
+// as many as the dedup window holds, seeking past the rest with the index.
+// The caller must hold fs.mu.
+func (fs *FileEventStore) loadIDsLocked() error {
+	if fs.ids != nil {
+		return nil
+	}
+	last, err := fs.lastSequenceLocked()
 	if err != nil {
-		return fmt.Errorf("failed to marshal event wrapper: %w", err)
+		return err
 	}
-
-	_, err = file.Write(append(wrappedData, '\n'))
+	ids := events.NewDedupWindow(fs.dedupWindow())
+	var from uint64
+	if window := uint64(ids.Window()); window > 0 && last > window {
+		from = last - window + 1
+	}
+	plan, err := fs.planLocked(from)
 	if err != nil {
-		return fmt.Errorf("failed to write event to file: %w", err)
+		return err
 	}
+	if err := readPlan(plan, from, func(record *events.Record) error {
+		ids.Add(record)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to read event IDs: %w", err)
+	}
+	fs.ids = ids
 	return nil
 }
 
-// LoadEvents reads all events from the file and deserializes them.
-func (fs *FileEventStore) LoadEvents() ([]events.Event, *errors.GameError) {
+// dedupWindow returns the window for events.NewDedupWindow, zero for every ID.
+func (fs *FileEventStore) dedupWindow() int {
+	switch {
+	case fs.opts.DedupWindow == 0:
+		return events.DefaultDedupWindow
+	case fs.opts.DedupWindow < 0:
+		return 0
+	}
+	return fs.opts.DedupWindow
+}
+
+// LastSequence returns the highest sequence number in the log, 0 if it is empty.
+// It opens the log for appending like Append, recovering a torn tail, and reads only
+// the records after the last index entry.
+func (fs *FileEventStore) LastSequence() (uint64, error) {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
+	if err := fs.openWriterLocked(); err != nil {
+		return 0, err
+	}
+	return fs.lastSequenceLocked()
+}
 
-	file, err := os.OpenFile(fs.filePath, os.O_RDONLY|os.O_CREATE, 0644)
+// lastSequenceLocked flushes the writer and reads the records after the last index entry
+// for the highest sequence number. The caller must hold fs.mu.
+func (fs *FileEventStore) lastSequenceLocked() (uint64, error) {
+	if err := fs.flushLocked(); err != nil {
+		return 0, err
+	}
+	plan, err := fs.planLocked(math.MaxUint64)
 	if err != nil {
-		return nil, errors.NewGameError(errors.ErrUnknown, fmt.Sprintf("failed to open event store file: %v", err))
+		return 0, err
 	}
-	defer file.Close()
-
-	var loadedEvents []events.Event
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Bytes()
-		if len(line) == 0 {
-			continue
+	var last uint64
+	if err := readPlan(plan, 0, func(record *events.Record) error {
+		if record.Sequence > last {
+			last = record.Sequence
 		}
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("failed to read the last sequence number: %w", err)
+	}
+	return last, nil
+}
+
+// Duplicates returns the number of records dropped by Append because the log already held their event ID.
+func (fs *FileEventStore) Duplicates() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.ids == nil {
+		return 0
+	}
+	return fs.ids.Dropped()
+}
 
-		var eventWrapper struct {
-			Type string          `json:"type"`
-			Data json.RawMessage `json:"data"`
+// ReadFrom streams the records of the file with a sequence number of at least from to fn.
+// Records written before metadata existed are numbered by their position in the log.
+// Only records appended before the call are read, so fn may safely append to the store.
+// Reading never changes the log: it fails with an error matching ErrCorrupt at the first
+// record that cannot be decoded, including a torn tail that Recover would remove.
+func (fs *FileEventStore) ReadFrom(from uint64, fn func(record *events.Record) error) error {
+	fs.mu.Lock()
+	if err := fs.flushLocked(); err != nil {
+		fs.mu.Unlock()
+		return err
+	}
+	plan, err := fs.planLocked(from)
+	fs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return readPlan(plan, from, fn)
+}
+
+// readRecords decodes records from r and passes those with a sequence of at least from to fn.
+// lastSequence is the sequence of the record before r and is advanced as records are read.
+// It reports whether fn stopped the read with ErrStop.
+func readRecords(r io.Reader, codec recordCodec, from uint64, lastSequence *uint64, fn func(record *events.Record) error) (bool, error) {
+	reader := bufio.NewReader(r)
+	for {
+		eventWrapper, _, err := codec.next(reader)
+		if err == io.EOF {
+			return false, nil
 		}
-		if err := json.Unmarshal(line, &eventWrapper); err != nil {
-			return nil, errors.NewGameError(errors.ErrUnknown, fmt.Sprintf("failed to unmarshal event wrapper: %v", err))
+		if stderrors.Is(err, errCorruptRecord) {
+			return false, errors.WrapGameError(errors.ErrCorruptEventLog, err, fmt.Sprintf("corrupt record after sequence %d", *lastSequence))
 		}
-
-		var event events.Event
-		switch eventWrapper.Type {
-		case "DamageUpgraded":
-			var e events.DamageUpgradedEvent
-			if err := json.Unmarshal(eventWrapper.Data, &e); err != nil {
-				return nil, errors.NewGameError(errors.ErrUnknown, fmt.Sprintf("failed to unmarshal DamageUpgradedEvent: %v", err))
-			}
-			event = &e
-		case "Click": // Added case for ClickEvent
-			var e events.ClickEvent
-			if err := json.Unmarshal(eventWrapper.Data, &e); err != nil {
-				return nil, errors.NewGameError(errors.ErrUnknown, fmt.Sprintf("failed to unmarshal ClickEvent: %v", err))
-			}
-			event = &e
-		case "UpgradePurchased": // Added case for UpgradePurchasedEvent
-			var e events.UpgradePurchasedEvent
-			if err := json.Unmarshal(eventWrapper.Data, &e); err != nil {
-				return nil, errors.NewGameError(errors.ErrUnknown, fmt.Sprintf("failed to unmarshal UpgradePurchasedEvent: %v", err))
+		if err != nil {
+			return false, fmt.Errorf("error reading event store file: %w", err)
+		}
+		if eventWrapper.Sequence == 0 {
+			eventWrapper.Sequence = *lastSequence + 1
+		}
+		*lastSequence = eventWrapper.Sequence
+		if eventWrapper.Sequence < from { // Skip earlier records before decoding the payload
+			continue
+		}
+		record, gerr := events.DecodeRecord(eventWrapper)
+		if gerr != nil {
+			return false, gerr
+		}
+		if err := fn(record); err != nil {
+			if err == events.ErrStop {
+				return true, nil
 			}
-			event = &e
-		// Add other event types here as they are defined
-		default:
-			return nil, errors.NewGameError(errors.ErrUnknownEventType, fmt.Sprintf("unknown event type: %s", eventWrapper.Type))
+			return false, fmt.Errorf("failed to process record %d: %w", record.Sequence, err)
 		}
-		loadedEvents = append(loadedEvents, event)
 	}
-
-	if err := scanner.Err(); err != nil {
-		return nil, errors.NewGameError(errors.ErrUnknown, fmt.Sprintf("error reading event store file: %v", err))
-	}
-
-	return loadedEvents, nil
 }
@@ -0,0 +1,813 @@
+package eventstore_test
+
+import (
+	"bytes"
+	"context"
+	stderrors "errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"clicker2/game/errors"
+	"clicker2/game/events"
+	"clicker2/game/eventstore"
+	"clicker2/game/eventstore/eventstoretest"
+)
+
+func appendClicks(t *testing.T, es events.EventStore, n int) {
+	t.Helper()
+	for i := 1; i <= n; i++ {
+		record := &events.Record{
+			Metadata: events.Metadata{Sequence: uint64(i), EventID: events.NewID()},
+			Event:    &events.ClickEvent{DamageDealt: 1, DustGained: 1, PlayerDustBefore: i - 1, PlayerDustAfter: i},
+		}
+		if err := es.Append(record); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+}
+
+// firstSegment returns the path of the first segment of a log written with the default options.
+func firstSegment(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-000001" + ext
+}
+
+func TestFileEventStoreReadFrom(t *testing.T) {
+	es := eventstore.NewFileEventStore(filepath.Join(t.TempDir(), "events.log"))
+	defer es.Close()
+	appendClicks(t, es, 5)
+
+	var sequences []uint64
+	err := es.ReadFrom(3, func(record *events.Record) error {
+		sequences = append(sequences, record.Sequence)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err.Error())
+	}
+	if len(sequences) != 3 || sequences[0] != 3 || sequences[2] != 5 {
+		t.Errorf("ReadFrom(3) sequences mismatch: got %v, want [3 4 5]", sequences)
+	}
+
+	// Returning ErrStop ends the read early without an error.
+	count := 0
+	err = es.ReadFrom(0, func(record *events.Record) error {
+		count++
+		return events.ErrStop
+	})
+	if err != nil || count != 1 {
+		t.Errorf("Expected to stop after 1 record without error, got %d records and %v", count, err)
+	}
+}
+
+func TestFileEventStoreLegacyLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	legacy := `{"type":"Click","data":{"PlayerID":"player1","DamageDealt":1,"DustGained":1,"RockHealthBefore":10000000,"RockHealthAfter":9999999,"PlayerDustBefore":0,"PlayerDustAfter":1}}
+{"type":"HeartTaken","data":{"PlayerID":"player1"}}
+`
+	if err := os.WriteFile(path, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := eventstore.LoadRecords(eventstore.NewFileEventStore(path))
+	if err != nil {
+		t.Fatalf("LoadRecords failed: %v", err.Error())
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(records))
+	}
+	for i, record := range records {
+		if record.Sequence != uint64(i+1) {
+			t.Errorf("Legacy record %d sequence mismatch: got %d, want %d", i, record.Sequence, i+1)
+		}
+	}
+	if records[1].Event.EventType() != "HeartTaken" {
+		t.Errorf("Expected HeartTaken, got %s", records[1].Event.EventType())
+	}
+}
+
+func TestFileEventStoreCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	es := eventstore.NewFileEventStore(path) // A log smaller than a segment is compacted too
+	defer es.Close()
+
+	// Three clicks, a purchase, then two more clicks.
+	dust, health := 0, 100
+	seq := uint64(0)
+	click := func() {
+		seq++
+		es.Append(&events.Record{
+			Metadata: events.Metadata{Sequence: seq, EventID: events.NewID()},
+			Event:    &events.ClickEvent{DamageDealt: 1, DustGained: 1, RockHealthBefore: health, RockHealthAfter: health - 1, PlayerDustBefore: dust, PlayerDustAfter: dust + 1},
+		})
+		dust, health = dust+1, health-1
+	}
+	click()
+	click()
+	click()
+	seq++
+	dust -= 2
+	es.Append(&events.Record{
+		Metadata: events.Metadata{Sequence: seq, EventID: events.NewID()},
+		Event:    &events.UpgradePurchasedEvent{UpgradeID: "stronger_pickaxe", NewLevel: 1, NewDust: dust},
+	})
+	click()
+	click()
+
+	stats, err := es.Compact(true)
+	if err != nil {
+		t.Fatalf("Compact failed: %v", err.Error())
+	}
+	if stats.RecordsIn != 6 || stats.RecordsOut != 3 {
+		t.Errorf("Compaction stats mismatch: got %d -> %d, want 6 -> 3", stats.RecordsIn, stats.RecordsOut)
+	}
+	if len(stats.ArchivePaths) != 1 {
+		t.Fatalf("Expected one archived log, got %v", stats.ArchivePaths)
+	}
+	if _, statErr := os.Stat(stats.ArchivePaths[0]); statErr != nil {
+		t.Errorf("Expected original log to be archived: %v", statErr)
+	}
+
+	records, err := eventstore.LoadRecords(es)
+	if err != nil {
+		t.Fatalf("LoadRecords failed: %v", err.Error())
+	}
+	first, ok := records[0].Event.(*events.ClicksAggregatedEvent)
+	if !ok {
+		t.Fatalf("Expected ClicksAggregated, got %s", records[0].Event.EventType())
+	}
+	if first.Clicks != 3 || first.FirstSequence != 1 || records[0].Sequence != 3 || first.PlayerDustAfter != 3 || first.RockHealthAfter != 97 {
+		t.Errorf("Aggregate mismatch: seq=%d %+v", records[0].Sequence, first)
+	}
+	if records[2].Sequence != 6 {
+		t.Errorf("Last aggregate sequence mismatch: got %d, want %d", records[2].Sequence, 6)
+	}
+
+	// Appending goes on in the compacted active segment.
+	click()
+	records, err = eventstore.LoadRecords(es)
+	if err != nil {
+		t.Fatalf("LoadRecords after appending failed: %v", err.Error())
+	}
+	if len(records) != 4 || records[3].Sequence != 7 {
+		t.Errorf("Expected the click appended after compaction to follow the aggregates, got %d records", len(records))
+	}
+}
+
+func TestFileEventStoreDedupWindow(t *testing.T) {
+	for window, want := range map[int]int{2: 0, -1: 1} {
+		path := filepath.Join(t.TempDir(), "events.log")
+		opts := eventstore.DefaultFileStoreOptions
+		opts.DedupWindow = window
+		es := eventstore.NewFileEventStoreWithOptions(path, opts)
+		first := &events.Record{Metadata: events.Metadata{Sequence: 1, EventID: events.NewID()}, Event: &events.ClickEvent{}}
+		es.Append(first)
+		for i := uint64(2); i <= 5; i++ {
+			es.Append(&events.Record{Metadata: events.Metadata{Sequence: i, EventID: events.NewID()}, Event: &events.ClickEvent{}})
+		}
+		es.Close()
+
+		// A reopened store learns the IDs from the log; the first record is outside a window of 2.
+		es = eventstore.NewFileEventStoreWithOptions(path, opts)
+		if err := es.Append(first); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+		if es.Duplicates() != want {
+			t.Errorf("Window %d: expected %d duplicates, got %d", window, want, es.Duplicates())
+		}
+		es.Close()
+	}
+}
+
+func TestFileEventStoreRecoversTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	writer := eventstore.NewFileEventStore(path)
+	appendClicks(t, writer, 3)
+	writer.Close()
+
+	// Simulate a crash halfway through writing a fourth record.
+	segment := firstSegment(path)
+	data, _ := os.ReadFile(segment)
+	torn := `{"type":"Click","version":1,"seq":4,"ts":"2026-01-0`
+	if err := os.WriteFile(segment, append(data, torn...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reading reports the torn record without touching the log.
+	es := eventstore.NewFileEventStore(path)
+	records, err := eventstore.LoadRecords(es)
+	if !stderrors.Is(err, eventstore.ErrCorrupt) || len(records) != 3 {
+		t.Fatalf("Expected 3 records and a corrupt log error, got %d records and %v", len(records), err)
+	}
+	if after, _ := os.ReadFile(segment); len(after) != len(data)+len(torn) || es.LastRecovery() != nil {
+		t.Fatalf("Reading changed the log: %d bytes, report %+v", len(after), es.LastRecovery())
+	}
+
+	if err := es.Recover(); err != nil {
+		t.Fatalf("Recover failed on torn log: %v", err)
+	}
+	if records, err = eventstore.LoadRecords(es); err != nil || len(records) != 3 {
+		t.Errorf("Expected 3 intact records after recovery, got %d and %v", len(records), err)
+	}
+	report := es.LastRecovery()
+	if report == nil || report.Bytes != int64(len(torn)) || report.Offset != int64(len(data)) {
+		t.Fatalf("Recovery report mismatch: got %+v", report)
+	}
+	quarantined, _ := os.ReadFile(report.QuarantinePath)
+	if string(quarantined) != torn {
+		t.Errorf("Quarantined tail mismatch: got %q, want %q", quarantined, torn)
+	}
+
+	// The log accepts new records after recovery.
+	appendClicks(t, es, 1)
+	es.Close()
+	if records, _ = eventstore.LoadRecords(eventstore.NewFileEventStore(path)); len(records) != 4 {
+		t.Errorf("Expected 4 records after appending to recovered log, got %d", len(records))
+	}
+}
+
+func TestFileEventStoreDetectsCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	writer := eventstore.NewFileEventStore(path)
+	appendClicks(t, writer, 3)
+	writer.Close()
+
+	// Flip a digit inside the first record; its checksum no longer matches.
+	data, _ := os.ReadFile(firstSegment(path))
+	i := bytes.Index(data, []byte(`"PlayerDustAfter":1`))
+	data[i+len(`"PlayerDustAfter":`)] = '9'
+	if err := os.WriteFile(firstSegment(path), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := eventstore.LoadRecords(eventstore.NewFileEventStore(path))
+	if !stderrors.Is(err, eventstore.ErrCorrupt) {
+		t.Errorf("Expected corrupt log error with code %d, got %v", errors.ErrCorruptEventLog, err)
+	}
+}
+
+func TestFileEventStoreBuffersUntilFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	es := eventstore.NewFileEventStoreWithOptions(path, eventstore.FileStoreOptions{FlushEvery: 3})
+	countOnDisk := func() int {
+		data, _ := os.ReadFile(path)
+		return bytes.Count(data, []byte("\n"))
+	}
+
+	appendClicks(t, es, 2)
+	if n := countOnDisk(); n != 0 {
+		t.Errorf("Expected records to be buffered, found %d on disk", n)
+	}
+	appendClicks(t, es, 1)
+	if n := countOnDisk(); n != 3 {
+		t.Errorf("Expected a flush at the threshold, found %d records on disk", n)
+	}
+
+	appendClicks(t, es, 1)
+	if err := es.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if n := countOnDisk(); n != 4 {
+		t.Errorf("Expected Close to flush, found %d records on disk", n)
+	}
+	if err := es.Append(&events.Record{Event: &events.ClickEvent{}}); !stderrors.Is(err, events.ErrClosed) {
+		t.Errorf("Expected ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestFileEventStoreSegments(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.log")
+	opts := eventstore.FileStoreOptions{FlushEvery: 1, SegmentSize: 1024, IndexEvery: 4}
+	es := eventstore.NewFileEventStoreWithOptions(path, opts)
+	appendClicks(t, es, 50)
+
+	sealed, err := es.SealedSegments()
+	if err != nil {
+		t.Fatalf("SealedSegments failed: %v", err)
+	}
+	if len(sealed) < 2 || filepath.Base(sealed[0]) != "events-000001.log" {
+		t.Fatalf("Expected the log to rotate into several segments, got %v", sealed)
+	}
+	if _, statErr := os.Stat(filepath.Join(dir, "events.idx")); statErr != nil {
+		t.Errorf("Expected an index next to the segments: %v", statErr)
+	}
+	if err := es.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// A fresh store finds every record again, starting anywhere in the log.
+	es = eventstore.NewFileEventStoreWithOptions(path, opts)
+	defer es.Close()
+	for _, from := range []uint64{0, 7, 23, 50} {
+		var sequences []uint64
+		gerr := es.ReadFrom(from, func(record *events.Record) error {
+			sequences = append(sequences, record.Sequence)
+			return nil
+		})
+		if gerr != nil {
+			t.Fatalf("ReadFrom(%d) failed: %v", from, gerr.Error())
+		}
+		first := from
+		if first == 0 {
+			first = 1
+		}
+		if uint64(len(sequences)) != 51-first || sequences[0] != first {
+			t.Errorf("ReadFrom(%d) sequences mismatch: got %v", from, sequences)
+		}
+	}
+
+	// Sealed segments can be compacted without touching the active one.
+	stats, gerr := es.Compact(false)
+	if gerr != nil {
+		t.Fatalf("Compact failed: %v", gerr.Error())
+	}
+	if stats.RecordsOut >= stats.RecordsIn {
+		t.Errorf("Expected sealed segments to shrink, got %d -> %d records", stats.RecordsIn, stats.RecordsOut)
+	}
+	records, gerr := eventstore.LoadRecords(es)
+	if gerr != nil {
+		t.Fatalf("LoadRecords after compaction failed: %v", gerr.Error())
+	}
+	if last := records[len(records)-1]; last.Sequence != 50 {
+		t.Errorf("Expected the log to end at sequence 50, got %d", last.Sequence)
+	}
+}
+
+func TestFileEventStoreCompactSealed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	opts := eventstore.FileStoreOptions{FlushEvery: 1, SegmentSize: 1024, IndexEvery: 4, CompactSealed: true}
+	es := eventstore.NewFileEventStoreWithOptions(path, opts)
+	appendClicks(t, es, 100)
+	if err := es.Close(); err != nil { // Waits for the compactions
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Every sealed segment collapsed into one aggregate; the active one is left alone.
+	sealed, err := es.SealedSegments()
+	if err != nil {
+		t.Fatalf("SealedSegments failed: %v", err)
+	}
+	records, gerr := eventstore.LoadRecords(es)
+	if gerr != nil {
+		t.Fatalf("LoadRecords failed: %v", gerr.Error())
+	}
+	clicks := 0
+	for i, record := range records {
+		switch e := record.Event.(type) {
+		case *events.ClicksAggregatedEvent:
+			clicks += e.Clicks
+			if i >= len(sealed) {
+				t.Errorf("Expected only sealed segments to be compacted, got an aggregate at record %d", i)
+			}
+		case *events.ClickEvent:
+			clicks++
+		}
+	}
+	if len(sealed) < 2 || len(records) >= 100 || clicks != 100 {
+		t.Errorf("Expected %d sealed segments to shrink the log, got %d records holding %d clicks", len(sealed), len(records), clicks)
+	}
+	if last := records[len(records)-1]; last.Sequence != 100 {
+		t.Errorf("Expected the log to end at sequence 100, got %d", last.Sequence)
+	}
+
+	// The index was rewritten for the compacted segments, so reads seek to the same records.
+	var want, got []uint64
+	for _, record := range records {
+		if record.Sequence >= 50 {
+			want = append(want, record.Sequence)
+		}
+	}
+	es.ReadFrom(50, func(record *events.Record) error {
+		got = append(got, record.Sequence)
+		return nil
+	})
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ReadFrom(50) sequences mismatch: got %v, want %v", got, want)
+	}
+}
+
+func TestFileEventStoreDefaultSegments(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.log")
+	es := eventstore.NewFileEventStore(path)
+	if exists, err := es.Exists(); err != nil || exists {
+		t.Fatalf("Expected no log yet, got %t, %v", exists, err)
+	}
+	appendClicks(t, es, 3)
+	if err := es.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	for _, name := range []string{"events-000001.log", "events.idx"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected the default options to write %s: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected no unsegmented log, got %v", err)
+	}
+
+	// A log written without segmentation is read as it is and becomes the first segment once appended to.
+	legacyPath := filepath.Join(dir, "legacy.log")
+	single := eventstore.DefaultFileStoreOptions
+	single.SegmentSize = 0
+	legacy := eventstore.NewFileEventStoreWithOptions(legacyPath, single)
+	appendClicks(t, legacy, 2)
+	legacy.Close()
+
+	es = eventstore.NewFileEventStore(legacyPath)
+	defer es.Close()
+	if records, err := eventstore.LoadRecords(es); err != nil || len(records) != 2 {
+		t.Fatalf("Expected 2 records in the unsegmented log, got %d and %v", len(records), err)
+	}
+	if err := es.Append(&events.Record{Metadata: events.Metadata{Sequence: 3, EventID: events.NewID()}, Event: &events.ClickEvent{}}); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if _, err := os.Stat(firstSegment(legacyPath)); err != nil {
+		t.Errorf("Expected the log to be moved into its first segment: %v", err)
+	}
+	if records, err := eventstore.LoadRecords(es); err != nil || len(records) != 3 {
+		t.Errorf("Expected 3 records after appending, got %d and %v", len(records), err)
+	}
+}
+
+func TestFileEventStoreConvertRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "events.log")
+	original := eventstore.NewFileEventStore(jsonPath)
+	appendClicks(t, original, 3)
+	more := []events.Event{
+		&events.UpgradePurchasedEvent{UpgradeID: "stronger_pickaxe", NewLevel: 1, NewDust: 0},
+		&events.DamageUpgradedEvent{PlayerID: "player1", NewDamage: 2},
+		&events.ClicksAggregatedEvent{PlayerID: "player1", Clicks: 4, FirstSequence: 6, TotalDamage: 8, TotalDust: 8},
+		&events.HeartTakenEvent{PlayerID: "player1"},
+		&events.MountainRestedEvent{PlayerID: "player1"},
+	}
+	session := events.NewID()
+	for i, event := range more {
+		record := &events.Record{
+			Metadata: events.Metadata{Sequence: uint64(4 + i), Timestamp: time.Now(), EventID: events.NewID(), SessionID: session},
+			Event:    event,
+		}
+		if err := original.Append(record); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	if err := original.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	binOpts := eventstore.DefaultFileStoreOptions
+	binOpts.Format = eventstore.FormatBinary
+	binary := eventstore.NewFileEventStoreWithOptions(filepath.Join(dir, "events.bin"), binOpts)
+	back := eventstore.NewFileEventStore(filepath.Join(dir, "events-back.log"))
+	if n, err := eventstore.Convert(original, binary); err != nil || n != 8 {
+		t.Fatalf("Convert to binary failed: %d records, %v", n, err)
+	}
+	if n, err := eventstore.Convert(binary, back); err != nil || n != 8 {
+		t.Fatalf("Convert to JSON failed: %d records, %v", n, err)
+	}
+	binary.Close()
+	back.Close()
+
+	jsonData, _ := os.ReadFile(firstSegment(jsonPath))
+	binData, _ := os.ReadFile(firstSegment(filepath.Join(dir, "events.bin")))
+	backData, _ := os.ReadFile(firstSegment(filepath.Join(dir, "events-back.log")))
+	if !bytes.Equal(jsonData, backData) {
+		t.Errorf("JSON -> binary -> JSON is not lossless:\n%s\nvs\n%s", jsonData, backData)
+	}
+	if len(binData) >= len(jsonData) {
+		t.Errorf("Expected the binary log to be smaller: %d bytes vs %d", len(binData), len(jsonData))
+	}
+
+	// Appending JSON records to the binary log is refused.
+	mismatched := eventstore.NewFileEventStore(filepath.Join(dir, "events.bin"))
+	defer mismatched.Close()
+	if err := mismatched.Append(&events.Record{Event: &events.ClickEvent{}}); err == nil {
+		t.Errorf("Expected appending JSON to a binary log to fail")
+	}
+}
+
+func TestFileEventStoreRecoversTornBinaryWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.bin")
+	opts := eventstore.DefaultFileStoreOptions
+	opts.Format = eventstore.FormatBinary
+	writer := eventstore.NewFileEventStoreWithOptions(path, opts)
+	appendClicks(t, writer, 4)
+	writer.Close()
+
+	// Cut the last frame in half, as a crash mid-write would.
+	data, _ := os.ReadFile(firstSegment(path))
+	if err := os.WriteFile(firstSegment(path), data[:len(data)-10], 0644); err != nil {
+		t.Fatalf("Failed to tear log: %v", err)
+	}
+
+	es := eventstore.NewFileEventStoreWithOptions(path, opts)
+	defer es.Close()
+	if _, err := eventstore.LoadRecords(es); !stderrors.Is(err, eventstore.ErrCorrupt) {
+		t.Fatalf("Expected a corrupt log error before recovery, got %v", err)
+	}
+	if err := es.Recover(); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	records, err := eventstore.LoadRecords(es)
+	if err != nil {
+		t.Fatalf("LoadRecords failed: %v", err.Error())
+	}
+	if len(records) != 3 || es.LastRecovery() == nil {
+		t.Fatalf("Expected the torn frame to be removed, got %d records and report %v", len(records), es.LastRecovery())
+	}
+	appendClicks(t, es, 1)
+	if records, _ = eventstore.LoadRecords(es); len(records) != 4 {
+		t.Errorf("Expected appends after recovery to be readable, got %d records", len(records))
+	}
+}
+
+func TestMemoryEventStoreConformance(t *testing.T) {
+	eventstoretest.Run(t, func(t *testing.T) events.EventStore {
+		return eventstore.NewMemoryEventStore()
+	})
+}
+
+func TestFileEventStoreConformance(t *testing.T) {
+	binary := eventstore.DefaultFileStoreOptions
+	binary.Format = eventstore.FormatBinary
+	segmented := eventstore.DefaultFileStoreOptions
+	segmented.SegmentSize, segmented.IndexEvery = 2048, 8
+	for name, opts := range map[string]eventstore.FileStoreOptions{
+		"JSON":      eventstore.DefaultFileStoreOptions,
+		"Binary":    binary,
+		"Segmented": segmented,
+	} {
+		opts := opts
+		t.Run(name, func(t *testing.T) {
+			eventstoretest.Run(t, func(t *testing.T) events.EventStore {
+				return eventstore.NewFileEventStoreWithOptions(filepath.Join(t.TempDir(), "events.log"), opts)
+			})
+		})
+	}
+}
+
+func TestSignedEventStoreConformance(t *testing.T) {
+	key := []byte("secret")
+	t.Run("Memory", func(t *testing.T) {
+		eventstoretest.Run(t, func(t *testing.T) events.EventStore {
+			return eventstore.NewSignedEventStore(eventstore.NewMemoryEventStore(), key)
+		})
+	})
+	binary := eventstore.DefaultFileStoreOptions
+	binary.Format = eventstore.FormatBinary
+	t.Run("Binary", func(t *testing.T) {
+		eventstoretest.Run(t, func(t *testing.T) events.EventStore {
+			inner := eventstore.NewFileEventStoreWithOptions(filepath.Join(t.TempDir(), "events.log"), binary)
+			return eventstore.NewSignedEventStore(inner, key)
+		})
+	})
+}
+
+func TestSignedEventStoreDetectsTampering(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	writer := eventstore.NewSignedEventStore(eventstore.NewFileEventStore(path), []byte("secret"))
+	appendClicks(t, writer, 3)
+	writer.Close()
+
+	if err := eventstore.NewSignedEventStore(eventstore.NewFileEventStore(path), []byte("secret")).Verify(); err != nil {
+		t.Fatalf("Expected the signed log to verify, got %v", err)
+	}
+	if err := eventstore.NewSignedEventStore(eventstore.NewFileEventStore(path), []byte("other")).Verify(); !stderrors.Is(err, eventstore.ErrTampered) {
+		t.Errorf("Expected a wrong key to be reported as tampering, got %v", err)
+	}
+
+	// Compaction would drop the MACs, so a signed log is left as it is.
+	before, _ := os.ReadFile(firstSegment(path))
+	if _, err := eventstore.NewFileEventStore(path).Compact(false); err == nil {
+		t.Errorf("Expected compacting a signed log to fail")
+	}
+	if after, _ := os.ReadFile(firstSegment(path)); !bytes.Equal(before, after) {
+		t.Errorf("Expected the signed log to be left unchanged")
+	}
+
+	// Rewrite the second record and recompute its checksum, as an editor that knows the format would.
+	inner := eventstore.NewFileEventStore(path)
+	records, err := eventstore.LoadRecords(inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records[1].Event.(*events.ClickEvent).PlayerDustAfter = 1000
+	tampered := filepath.Join(t.TempDir(), "tampered.log")
+	out := eventstore.NewFileEventStore(tampered)
+	for _, record := range records {
+		if err := out.Append(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out.Close()
+
+	var read []uint64
+	err = eventstore.NewSignedEventStore(eventstore.NewFileEventStore(tampered), []byte("secret")).ReadFrom(0, func(r *events.Record) error {
+		read = append(read, r.Sequence)
+		return nil
+	})
+	if !stderrors.Is(err, eventstore.ErrTampered) {
+		t.Fatalf("Expected tampered log error with code %d, got %v", errors.ErrTamperedEventLog, err)
+	}
+	if len(read) != 1 {
+		t.Errorf("Expected only the record before the tampered one to be read, got %v", read)
+	}
+
+	// A naive edit breaks the checksum of the record, which is tampering too, even in the last record.
+	data, _ := os.ReadFile(firstSegment(path))
+	i := bytes.LastIndex(data, []byte(`"PlayerDustAfter":3`))
+	data[i+len(`"PlayerDustAfter":`)] = '9'
+	if err := os.WriteFile(firstSegment(path), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	edited := eventstore.NewSignedEventStore(eventstore.NewFileEventStore(path), []byte("secret"))
+	if _, err := eventstore.LoadRecords(edited); !stderrors.Is(err, eventstore.ErrTampered) {
+		t.Errorf("Expected an edited last record to be reported as tampering, got %v", err)
+	}
+	if err := edited.Append(&events.Record{Metadata: events.Metadata{Sequence: 4}, Event: &events.ClickEvent{}}); !stderrors.Is(err, eventstore.ErrTampered) {
+		t.Errorf("Expected appending to an edited log to fail, got %v", err)
+	}
+
+	// Unsigned records are rejected as well.
+	unsigned := filepath.Join(t.TempDir(), "unsigned.log")
+	plain := eventstore.NewFileEventStore(unsigned)
+	appendClicks(t, plain, 1)
+	plain.Close()
+	signed := eventstore.NewSignedEventStore(eventstore.NewFileEventStore(unsigned), []byte("secret"))
+	if err := signed.Append(&events.Record{Metadata: events.Metadata{Sequence: 2}, Event: &events.ClickEvent{}}); !stderrors.Is(err, eventstore.ErrTampered) {
+		t.Errorf("Expected appending to an unsigned log to fail, got %v", err)
+	}
+}
+
+func TestFileEventStoreDropsDuplicatesAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	writer := eventstore.NewFileEventStore(path)
+	appendClicks(t, writer, 3)
+	writer.Close()
+	records, err := eventstore.LoadRecords(eventstore.NewFileEventStore(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Merge the log into itself, as a sync resending everything would.
+	merged := eventstore.NewFileEventStore(path)
+	defer merged.Close()
+	for _, record := range records {
+		if err := merged.Append(record); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	if merged.Duplicates() != 3 {
+		t.Errorf("Expected all 3 resent records to be dropped, got %d", merged.Duplicates())
+	}
+	if all, _ := eventstore.LoadRecords(merged); len(all) != 3 {
+		t.Errorf("Expected 3 records after merging, got %d", len(all))
+	}
+}
+
+func TestFileEventStoreFork(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.log")
+	parent := eventstore.NewFileEventStore(path)
+	defer parent.Close()
+	appendClicks(t, parent, 5)
+
+	branch := filepath.Join(dir, "branch.log")
+	info, err := parent.Fork(branch, 3)
+	if err != nil {
+		t.Fatalf("Fork failed: %v", err)
+	}
+	records, _ := eventstore.LoadRecords(parent)
+	if info.Parent != path || info.Sequence != 3 || info.EventID != records[2].EventID {
+		t.Errorf("Fork info mismatch: %+v", info)
+	}
+	if read, err := eventstore.ReadForkInfo(branch); err != nil || read.Parent != path || read.Sequence != 3 {
+		t.Errorf("Expected the fork info to be stored next to the branch, got %+v, %v", read, err)
+	}
+	if read, err := eventstore.ReadForkInfo(path); err != nil || read != nil {
+		t.Errorf("Expected no fork info for the parent, got %+v, %v", read, err)
+	}
+
+	// Both timelines go on independently.
+	child := eventstore.NewFileEventStore(branch)
+	defer child.Close()
+	if err := child.Append(&events.Record{Metadata: events.Metadata{Sequence: 4, EventID: events.NewID()}, Event: &events.ClickEvent{}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := eventstore.LoadRecords(child); len(got) != 4 || got[3].EventID == records[3].EventID {
+		t.Errorf("Expected the branch to hold 3 copied records and its own fourth, got %d", len(got))
+	}
+	if got, _ := eventstore.LoadRecords(parent); len(got) != 5 {
+		t.Errorf("Expected the parent to be left intact, got %d records", len(got))
+	}
+
+	if _, err := parent.Fork(branch, 2); err == nil {
+		t.Error("Expected forking onto an existing log to fail")
+	}
+	if _, err := parent.Fork(filepath.Join(dir, "missing.log"), 9); err == nil {
+		t.Error("Expected forking past the end of the log to fail")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing.log")); !os.IsNotExist(err) {
+		t.Errorf("Expected a failed fork to leave nothing behind, got %v", err)
+	}
+}
+
+func TestFileEventStoreFollow(t *testing.T) {
+	opts := eventstore.DefaultFileStoreOptions
+	opts.FlushEvery, opts.SegmentSize, opts.FollowInterval = 1, 1024, 5*time.Millisecond
+	path := filepath.Join(t.TempDir(), "events.log")
+	writer := eventstore.NewFileEventStoreWithOptions(path, opts)
+	defer writer.Close()
+	appendClicks(t, writer, 3)
+
+	// The follower reads the files only, like a tool in another process would.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	received := make(chan uint64, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- eventstore.NewFileEventStoreWithOptions(path, opts).Follow(ctx, 2, func(r *events.Record) error {
+			received <- r.Sequence
+			return nil
+		})
+	}()
+	expect := func(want ...uint64) {
+		t.Helper()
+		for _, w := range want {
+			select {
+			case got := <-received:
+				if got != w {
+					t.Fatalf("Expected record %d, got %d", w, got)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("Timed out waiting for record %d", w)
+			}
+		}
+	}
+	expect(2, 3)
+
+	// New records follow as they are appended, across segment rotations.
+	var want []uint64
+	for seq := uint64(4); seq <= 40; seq++ {
+		if err := writer.Append(&events.Record{
+			Metadata: events.Metadata{Sequence: seq, EventID: events.NewID()},
+			Event:    &events.ClickEvent{DamageDealt: 1, DustGained: 1},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, seq)
+	}
+	expect(want...)
+	if sealed, _ := writer.SealedSegments(); len(sealed) == 0 {
+		t.Fatal("Expected the log to have rotated")
+	}
+
+	// A record that is only partly written is delivered once it is complete.
+	segments, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "events-*.log"))
+	active := segments[len(segments)-1]
+	data, _ := os.ReadFile(active)
+	line := data[bytes.LastIndexByte(data[:len(data)-1], '\n')+1:]
+	file, _ := os.OpenFile(active, os.O_APPEND|os.O_WRONLY, 0644)
+	file.Write(line[:len(line)/2])
+	file.Close()
+	select {
+	case got := <-received:
+		t.Fatalf("Expected a partial record not to be delivered, got %d", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+	os.WriteFile(active, data, 0644) // Roll the partial write back
+	if err := writer.Append(&events.Record{Metadata: events.Metadata{Sequence: 41, EventID: events.NewID()}, Event: &events.ClickEvent{}}); err != nil {
+		t.Fatal(err)
+	}
+	expect(41)
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Expected Follow to end with the context, got %v", err)
+	}
+}
+
+func TestFileEventStoreFollowStop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	es := eventstore.NewFileEventStore(path)
+	defer es.Close()
+	appendClicks(t, es, 5)
+
+	var read []uint64
+	err := es.Follow(context.Background(), 0, func(r *events.Record) error {
+		read = append(read, r.Sequence)
+		if len(read) == 3 {
+			return events.ErrStop
+		}
+		return nil
+	})
+	if err != nil || len(read) != 3 {
+		t.Errorf("Expected Follow to stop after 3 records, got %v and %v", read, err)
+	}
+}
@@ -0,0 +1,284 @@
+// Package eventstoretest provides a conformance suite for events.EventStore implementations.
+//
+// A store's tests call Run with a constructor for empty stores:
+//
+//	func TestMyStore(t *testing.T) {
+//		eventstoretest.Run(t, func(t *testing.T) events.EventStore {
+//			return NewMyStore(t.TempDir())
+//		})
+//	}
+package eventstoretest
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"clicker2/game/events"
+)
+
+// Run runs the conformance suite against stores created by newStore.
+// Every subtest gets a fresh, empty store and closes it when done.
+func Run(t *testing.T, newStore func(t *testing.T) events.EventStore) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, es events.EventStore)
+	}{
+		{"Ordering", testOrdering},
+		{"ReadFromOffset", testReadFromOffset},
+		{"Stop", testStop},
+		{"RoundTripEveryEventType", testRoundTrip},
+		{"ConcurrentAppends", testConcurrentAppends},
+		{"AppendWhileReading", testAppendWhileReading},
+		{"FlushAndClose", testFlushAndClose},
+		{"DropsDuplicates", testDropsDuplicates},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			es := newStore(t)
+			defer es.Close()
+			tt.run(t, es)
+		})
+	}
+}
+
+// record returns a click record with the given sequence.
+func record(sequence uint64) *events.Record {
+	return &events.Record{
+		Metadata: events.Metadata{Sequence: sequence, Timestamp: time.Now(), EventID: events.NewID(), SessionID: "conformance"},
+		Event:    &events.ClickEvent{PlayerID: "player1", DamageDealt: 1, DustGained: 1, PlayerDustAfter: int(sequence)},
+	}
+}
+
+func appendN(t *testing.T, es events.EventStore, n int) {
+	t.Helper()
+	for i := 1; i <= n; i++ {
+		if err := es.Append(record(uint64(i))); err != nil {
+			t.Fatalf("Append(%d) failed: %v", i, err)
+		}
+	}
+}
+
+func readSequences(t *testing.T, es events.EventStore, from uint64) []uint64 {
+	t.Helper()
+	var sequences []uint64
+	if err := es.ReadFrom(from, func(r *events.Record) error {
+		sequences = append(sequences, r.Sequence)
+		return nil
+	}); err != nil {
+		t.Fatalf("ReadFrom(%d) failed: %v", from, err.Error())
+	}
+	return sequences
+}
+
+func testOrdering(t *testing.T, es events.EventStore) {
+	appendN(t, es, 100)
+	sequences := readSequences(t, es, 0)
+	if len(sequences) != 100 {
+		t.Fatalf("Expected 100 records, got %d", len(sequences))
+	}
+	for i, sequence := range sequences {
+		if sequence != uint64(i+1) {
+			t.Fatalf("Record %d has sequence %d, want %d", i, sequence, i+1)
+		}
+	}
+}
+
+func testReadFromOffset(t *testing.T, es events.EventStore) {
+	appendN(t, es, 20)
+	for _, from := range []uint64{1, 2, 10, 20} {
+		sequences := readSequences(t, es, from)
+		if uint64(len(sequences)) != 21-from || sequences[0] != from {
+			t.Errorf("ReadFrom(%d) returned %v", from, sequences)
+		}
+	}
+	if sequences := readSequences(t, es, 21); len(sequences) != 0 {
+		t.Errorf("ReadFrom past the end returned %v", sequences)
+	}
+}
+
+func testStop(t *testing.T, es events.EventStore) {
+	appendN(t, es, 5)
+	count := 0
+	err := es.ReadFrom(0, func(r *events.Record) error {
+		count++
+		if count == 2 {
+			return events.ErrStop
+		}
+		return nil
+	})
+	if err != nil || count != 2 {
+		t.Errorf("Expected ErrStop to end the read after 2 records without an error, got %d records and %v", count, err)
+	}
+
+	failure := errors.New("callback failed")
+	if err := es.ReadFrom(0, func(r *events.Record) error { return failure }); !errors.Is(err, failure) {
+		t.Errorf("Expected the callback error to be reported wrapped, got %v", err)
+	}
+}
+
+// testRoundTrip appends one record of every registered event type, with every field set,
+// and expects to read back the same metadata and events.
+func testRoundTrip(t *testing.T, es events.EventStore) {
+	types := events.RegisteredTypes()
+	sort.Strings(types)
+	var want []*events.Record
+	for i, eventType := range types {
+		event, _ := events.NewEvent(eventType)
+		fill(reflect.ValueOf(event).Elem(), i)
+		r := &events.Record{
+			Metadata: events.Metadata{
+				Sequence:  uint64(i + 1),
+				Timestamp: time.Date(2024, 5, 1, 12, 0, i, 123456789, time.UTC),
+				EventID:   events.NewID(),
+				SessionID: "round-trip",
+			},
+			Event: event,
+		}
+		if err := es.Append(r); err != nil {
+			t.Fatalf("Append(%s) failed: %v", eventType, err)
+		}
+		want = append(want, r)
+	}
+
+	var got []*events.Record
+	if err := es.ReadFrom(0, func(r *events.Record) error {
+		got = append(got, r)
+		return nil
+	}); err != nil {
+		t.Fatalf("ReadFrom failed: %v", err.Error())
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d records, got %d", len(want), len(got))
+	}
+	for i := range want {
+		w, g := want[i], got[i]
+		if g.Sequence != w.Sequence || !g.Timestamp.Equal(w.Timestamp) || g.EventID != w.EventID || g.SessionID != w.SessionID {
+			t.Errorf("%s metadata mismatch: got %+v, want %+v", w.Event.EventType(), g.Metadata, w.Metadata)
+		}
+		if !reflect.DeepEqual(g.Event, w.Event) {
+			t.Errorf("%s event mismatch: got %+v, want %+v", w.Event.EventType(), g.Event, w.Event)
+		}
+	}
+}
+
+// fill sets every exported field of v to a value derived from its position and seed.
+func fill(v reflect.Value, seed int) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if !field.CanSet() {
+			continue
+		}
+		n := seed*100 + i + 1
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(fmt.Sprintf("%s-%d", v.Type().Field(i).Name, n))
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			field.SetInt(int64(n))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			field.SetUint(uint64(n))
+		case reflect.Float32, reflect.Float64:
+			field.SetFloat(float64(n) + 0.5)
+		case reflect.Bool:
+			field.SetBool(true)
+		case reflect.Struct:
+			fill(field, n)
+		}
+	}
+}
+
+func testConcurrentAppends(t *testing.T, es events.EventStore) {
+	const writers, perWriter = 8, 50
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				if err := es.Append(record(uint64(w*perWriter + i + 1))); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Concurrent Append failed: %v", err)
+	}
+
+	seen := make(map[uint64]bool)
+	for _, sequence := range readSequences(t, es, 0) {
+		if seen[sequence] {
+			t.Fatalf("Sequence %d was read twice", sequence)
+		}
+		seen[sequence] = true
+	}
+	if len(seen) != writers*perWriter {
+		t.Errorf("Expected %d records, got %d", writers*perWriter, len(seen))
+	}
+}
+
+func testAppendWhileReading(t *testing.T, es events.EventStore) {
+	appendN(t, es, 3)
+	next := uint64(4)
+	read := 0
+	err := es.ReadFrom(0, func(r *events.Record) error {
+		read++
+		if err := es.Append(record(next)); err != nil {
+			return err
+		}
+		next++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err.Error())
+	}
+	if read != 3 {
+		t.Errorf("Expected only the 3 records present when reading started, got %d", read)
+	}
+	if sequences := readSequences(t, es, 0); len(sequences) != 6 {
+		t.Errorf("Expected the appended records to be stored, got %v", sequences)
+	}
+}
+
+func testFlushAndClose(t *testing.T, es events.EventStore) {
+	appendN(t, es, 3)
+	if err := es.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if err := es.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := es.Append(record(4)); !errors.Is(err, events.ErrClosed) {
+		t.Errorf("Expected ErrClosed when appending to a closed store, got %v", err)
+	}
+	if sequences := readSequences(t, es, 0); len(sequences) != 3 {
+		t.Errorf("Expected a closed store to stay readable, got %v", sequences)
+	}
+	if err := es.Close(); err != nil {
+		t.Errorf("Closing twice failed: %v", err)
+	}
+}
+
+// testDropsDuplicates resends records already in the store and expects them to be dropped.
+func testDropsDuplicates(t *testing.T, es events.EventStore) {
+	first, second := record(1), record(2)
+	for _, r := range []*events.Record{first, second, first, second, record(3)} {
+		if err := es.Append(r); err != nil {
+			t.Fatalf("Append(%d) failed: %v", r.Sequence, err)
+		}
+	}
+	if sequences := readSequences(t, es, 0); !reflect.DeepEqual(sequences, []uint64{1, 2, 3}) {
+		t.Errorf("Expected the resent records to be dropped, got %v", sequences)
+	}
+	if counter, ok := es.(interface{ Duplicates() int }); ok && counter.Duplicates() != 2 {
+		t.Errorf("Expected 2 duplicates to be reported, got %d", counter.Duplicates())
+	}
+}
@@ -0,0 +1,200 @@
+package eventstore
+
+import (
+	"bufio"
+	"context"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"clicker2/game/errors"
+	"clicker2/game/events"
+)
+
+// DefaultFollowInterval is how often Follow checks the log for new records.
+const DefaultFollowInterval = 100 * time.Millisecond
+
+// errFollowStopped ends a follow when the callback returns events.ErrStop.
+var errFollowStopped = stderrors.New("follow stopped")
+
+// Follow streams the records with a sequence number of at least from to fn, like ReadFrom,
+// and then keeps waiting for new records and streams them as they are appended, checking
+// every FollowInterval. It returns ctx.Err() once ctx is done, nil if fn returns events.ErrStop,
+// and the first other error of fn or of reading the log.
+//
+// Follow only reads the files of the log, so a tool can follow the log of a game running in
+// another process; records appear once that process flushes them, see FileStoreOptions, and
+// a record still being written is picked up once it is complete. Follow moves on to new
+// segments as the log rotates. If the file it reads is replaced or truncated, e.g. by Compact,
+// it reads the log again from the first record it has not delivered yet, so a ClicksAggregated
+// event may then cover some clicks that were already delivered.
+func (fs *FileEventStore) Follow(ctx context.Context, from uint64, fn func(record *events.Record) error) error {
+	interval := fs.opts.FollowInterval
+	if interval <= 0 {
+		interval = DefaultFollowInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	f := &follower{fs: fs, next: from}
+	for {
+		if err := f.poll(fn); err != nil {
+			if err == errFollowStopped {
+				return nil
+			}
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// follower is the position of Follow in the log.
+type follower struct {
+	fs           *FileEventStore
+	next         uint64      // Lowest sequence number not delivered yet
+	lastSequence uint64      // Sequence of the last record read, delivered or not
+	path         string      // File being read, empty to plan from next again
+	file         os.FileInfo // Identifies that file, to notice when it is replaced
+	offset       int64       // End of the last complete record read from that file
+}
+
+// poll delivers the records appended since the last poll.
+func (f *follower) poll(fn func(record *events.Record) error) error {
+	f.fs.mu.Lock()
+	err := f.fs.flushLocked() // Records buffered by this process
+	var plan []segmentRange
+	if err == nil {
+		plan, err = f.planLocked()
+	}
+	f.fs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for i, r := range plan {
+		complete, err := f.read(r, i == len(plan)-1, fn)
+		if err != nil || !complete {
+			return err
+		}
+	}
+	return nil
+}
+
+// planLocked returns the parts of the log to read next: the rest of the current file and
+// the segments after it. It does not recover the log, which may be written by another process.
+// The caller must hold fs.mu.
+func (f *follower) planLocked() ([]segmentRange, error) {
+	if f.path != "" {
+		segments, err := f.fs.segments()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list event log segments: %w", err)
+		}
+		for i, s := range segments {
+			if s.path != f.path {
+				continue
+			}
+			info, err := os.Stat(s.path)
+			if err != nil || !os.SameFile(info, f.file) || info.Size() < f.offset {
+				break // Replaced, truncated or moved away
+			}
+			plan := []segmentRange{{path: s.path, offset: f.offset, size: info.Size(), lastSequence: f.lastSequence}}
+			for _, later := range segments[i+1:] {
+				plan = append(plan, segmentRange{path: later.path})
+			}
+			return plan, nil
+		}
+	}
+
+	f.path, f.lastSequence = "", 0
+	return f.fs.planLocked(f.next)
+}
+
+// read delivers the records in r up to the current end of the file, whatever its planned size.
+// It reports false if it stopped at a record that is not completely written yet, which can only
+// be at the end of the last file, or if the file disappeared.
+func (f *follower) read(r segmentRange, last bool, fn func(record *events.Record) error) (bool, error) {
+	file, err := os.Open(r.path)
+	if os.IsNotExist(err) {
+		f.path = "" // Moved away since it was planned
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to open event store file: %w", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to stat event store file: %w", err)
+	}
+	if r.path != f.path {
+		f.path, f.file, f.offset = r.path, info, 0
+		if r.lastSequence > f.lastSequence {
+			f.lastSequence = r.lastSequence
+		}
+	}
+
+	format, ok, err := detectFormat(r.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read event store file: %w", err)
+	}
+	if !ok {
+		return true, nil // Empty so far
+	}
+	codec := codecFor(format)
+	offset := r.offset
+	if header := int64(len(codec.header())); offset < header {
+		if info.Size() < header {
+			return false, nil // Header not completely written
+		}
+		offset = header
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return false, fmt.Errorf("failed to seek event store file: %w", err)
+	}
+
+	reader := bufio.NewReader(io.LimitReader(file, info.Size()-offset))
+	for {
+		env, n, err := codec.next(reader)
+		if err == io.EOF {
+			f.offset = offset
+			return true, nil
+		}
+		if stderrors.Is(err, errCorruptRecord) {
+			if last && offset+int64(n) >= info.Size() {
+				f.offset = offset
+				return false, nil // Still being written
+			}
+			return false, errors.WrapGameError(errors.ErrCorruptEventLog, err, fmt.Sprintf("corrupt record after sequence %d", f.lastSequence))
+		}
+		if err != nil {
+			return false, fmt.Errorf("error reading event store file: %w", err)
+		}
+		offset += int64(n)
+		f.offset = offset
+
+		if env.Sequence == 0 {
+			env.Sequence = f.lastSequence + 1
+		}
+		f.lastSequence = env.Sequence
+		if env.Sequence < f.next {
+			continue
+		}
+		record, gerr := events.DecodeRecord(env)
+		if gerr != nil {
+			return false, gerr
+		}
+		f.next = record.Sequence + 1
+		if err := fn(record); err != nil {
+			if err == events.ErrStop {
+				return false, errFollowStopped
+			}
+			return false, fmt.Errorf("failed to process record %d: %w", record.Sequence, err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package eventstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"clicker2/game/events"
+)
+
+// ForkInfo records where a forked event log branched off its parent, see FileEventStore.Fork.
+// It is kept as JSON next to the forked log, "branch.log.fork.json" for a log at "branch.log".
+type ForkInfo struct {
+	Parent   string    `json:"parent"`   // Path of the parent log
+	Sequence uint64    `json:"sequence"` // Last record copied from the parent, 0 for a fork before the first one
+	EventID  string    `json:"id"`       // Event ID of that record; lost if compaction folds the record into an aggregate
+	Created  time.Time `json:"created"`
+}
+
+func forkInfoPath(logPath string) string {
+	return logPath + ".fork.json"
+}
+
+// ReadForkInfo returns where the log at logPath was forked from, or nil if it was not forked.
+func ReadForkInfo(logPath string) (*ForkInfo, error) {
+	data, err := os.ReadFile(forkInfoPath(logPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var info ForkInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("failed to read fork info of %s: %w", logPath, err)
+	}
+	return &info, nil
+}
+
+// Fork copies the records of the log up to and including sequence into a new log at path,
+// written with the same options, and records the fork point next to it. The log itself is
+// left untouched. Records are copied as they are, so a fork of a signed log is signed too.
+// Sequence must be 0 or the sequence number of a record in the log.
+func (fs *FileEventStore) Fork(path string, sequence uint64) (*ForkInfo, error) {
+	child := NewFileEventStoreWithOptions(path, fs.opts)
+	segments, err := child.segments()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list event log segments: %w", err)
+	}
+	for _, s := range append(segments, segment{path: path}) {
+		if _, err := os.Stat(s.path); err == nil {
+			return nil, fmt.Errorf("%s already exists", s.path)
+		}
+	}
+
+	info := &ForkInfo{Parent: fs.filePath, Created: time.Now()}
+	err = fs.ReadFrom(0, func(record *events.Record) error {
+		if record.Sequence > sequence {
+			return events.ErrStop
+		}
+		info.Sequence, info.EventID = record.Sequence, record.EventID
+		return child.Append(record)
+	})
+	if closeErr := child.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && info.Sequence != sequence {
+		err = fmt.Errorf("%s has no record with sequence %d, the last one before it is %d", fs.filePath, sequence, info.Sequence)
+	}
+	if err == nil {
+		var data []byte
+		if data, err = json.MarshalIndent(info, "", "  "); err == nil {
+			err = os.WriteFile(forkInfoPath(path), data, 0644)
+		}
+	}
+	if err != nil {
+		child.remove()
+		return nil, fmt.Errorf("failed to fork %s at sequence %d: %w", fs.filePath, sequence, err)
+	}
+	return info, nil
+}
+
+// remove deletes every file of a log that is not in use, after a failed fork.
+func (fs *FileEventStore) remove() {
+	segments, _ := fs.segments()
+	for _, s := range segments {
+		os.Remove(s.path)
+	}
+	if fs.segmented() {
+		os.Remove(fs.indexPath())
+	}
+	os.Remove(fs.filePath)
+	os.Remove(forkInfoPath(fs.filePath))
+}
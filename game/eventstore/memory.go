@@ -0,0 +1,121 @@
+package eventstore
+
+import (
+	"fmt"
+	"sync"
+
+	"clicker2/game/events"
+)
+
+// MemoryEventStore implements events.EventStore in memory, for tests and games that need no persistence.
+// Records are kept encoded, just like on disk, so readers get their own copies and
+// events that cannot be serialized fail on append rather than on replay.
+type MemoryEventStore struct {
+	mu      sync.Mutex
+	records []*events.Envelope
+	ids     *events.Dedup
+	closed  bool
+}
+
+// NewMemoryEventStore creates an empty MemoryEventStore. It keeps every record anyway,
+// so it checks appends against every event ID rather than a window of them.
+func NewMemoryEventStore() *MemoryEventStore {
+	return &MemoryEventStore{ids: events.NewDedupWindow(0)}
+}
+
+// Append encodes a record and adds it to the end of the store,
+// unless the store already holds a record with its event ID.
+func (ms *MemoryEventStore) Append(record *events.Record) error {
+	env, err := events.EncodeRecord(record)
+	if err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.closed {
+		return events.ErrClosed
+	}
+	if ms.ids.Duplicate(record) {
+		return nil
+	}
+	ms.ids.Add(record)
+	ms.records = append(ms.records, env)
+	return nil
+}
+
+// ReadFrom streams the records with a sequence number of at least from to fn.
+// Only records appended before the call are read, so fn may safely append to the store.
+func (ms *MemoryEventStore) ReadFrom(from uint64, fn func(record *events.Record) error) error {
+	ms.mu.Lock()
+	envelopes := ms.records[:len(ms.records):len(ms.records)]
+	ms.mu.Unlock()
+
+	var lastSequence uint64
+	for _, env := range envelopes {
+		sequence := env.Sequence
+		if sequence == 0 { // Numbered by position, like records in a legacy log
+			sequence = lastSequence + 1
+		}
+		lastSequence = sequence
+		if sequence < from {
+			continue
+		}
+		record, gerr := events.DecodeRecord(env)
+		if gerr != nil {
+			return gerr
+		}
+		record.Sequence = sequence
+		if err := fn(record); err != nil {
+			if err == events.ErrStop {
+				return nil
+			}
+			return fmt.Errorf("failed to process record %d: %w", record.Sequence, err)
+		}
+	}
+	return nil
+}
+
+// LastSequence returns the highest sequence number in the store, 0 if it is empty.
+func (ms *MemoryEventStore) LastSequence() (uint64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var last, previous uint64
+	for _, env := range ms.records {
+		sequence := env.Sequence
+		if sequence == 0 { // Numbered by position, see ReadFrom
+			sequence = previous + 1
+		}
+		previous = sequence
+		if sequence > last {
+			last = sequence
+		}
+	}
+	return last, nil
+}
+
+// Len returns the number of records in the store.
+func (ms *MemoryEventStore) Len() int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return len(ms.records)
+}
+
+// Duplicates returns the number of records dropped by Append because the store already held their event ID.
+func (ms *MemoryEventStore) Duplicates() int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.ids.Dropped()
+}
+
+// Flush does nothing; records are stored as soon as they are appended.
+func (ms *MemoryEventStore) Flush() error {
+	return nil
+}
+
+// Close makes further appends fail with events.ErrClosed; reading is still possible.
+func (ms *MemoryEventStore) Close() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.closed = true
+	return nil
+}
@@ -0,0 +1,197 @@
+package eventstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"clicker2/game/errors"
+	"clicker2/game/events"
+)
+
+// SyncMode selects when a FileEventStore forces written records to stable storage.
+type SyncMode int
+
+const (
+	// SyncNever leaves flushing to the operating system.
+	SyncNever SyncMode = iota
+	// SyncAlways syncs after every record.
+	SyncAlways
+	// SyncEveryN syncs after every SyncPolicy.Every records.
+	SyncEveryN
+	// SyncInterval syncs when at least SyncPolicy.Interval passed since the last sync.
+	SyncInterval
+)
+
+// SyncPolicy configures the durability of a FileEventStore.
+type SyncPolicy struct {
+	Mode     SyncMode
+	Every    int           // Used by SyncEveryN
+	Interval time.Duration // Used by SyncInterval
+}
+
+// RecoveryMode selects what a FileEventStore does with a corrupt tail found when it is opened.
+type RecoveryMode int
+
+const (
+	// RecoverQuarantine moves the corrupt tail to a separate file before truncating the log.
+	RecoverQuarantine RecoveryMode = iota
+	// RecoverTruncate drops the corrupt tail.
+	RecoverTruncate
+)
+
+// RecoveryReport describes a corrupt tail that was removed from an event log.
+type RecoveryReport struct {
+	Offset         int64  // Byte offset at which the log was truncated
+	Bytes          int64  // Number of bytes removed
+	QuarantinePath string // Where the removed bytes were saved, empty for RecoverTruncate
+}
+
+// checksumSuffix is the JSON field appended to every record line, followed by 8 hex digits and `"}`.
+const checksumSuffix = `,"crc":"`
+
+// checksumLen is the length of the checksum field including the closing brace.
+const checksumLen = len(checksumSuffix) + 8 + 2
+
+// addChecksum appends a CRC-32 of the JSON object body to it as a final "crc" field.
+func addChecksum(body []byte) []byte {
+	sum := crc32.ChecksumIEEE(body)
+	line := append(body[:len(body)-1:len(body)-1], fmt.Sprintf(`%s%08x"}`, checksumSuffix, sum)...)
+	return append(line, '\n')
+}
+
+// decodeLine parses a record line, verifying its checksum if it has one.
+// Lines written before checksums existed are accepted as they are.
+func decodeLine(line []byte) (*events.Envelope, error) {
+	if n := len(line); n > checksumLen && bytes.Equal(line[n-checksumLen:n-checksumLen+len(checksumSuffix)], []byte(checksumSuffix)) {
+		want, err := strconv.ParseUint(string(line[n-10:n-2]), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("malformed checksum: %w", err)
+		}
+		body := append(line[:n-checksumLen:n-checksumLen], '}')
+		if crc32.ChecksumIEEE(body) != uint32(want) {
+			return nil, fmt.Errorf("checksum mismatch")
+		}
+	}
+
+	var env events.Envelope
+	if err := json.Unmarshal(line, &env); err != nil {
+		return nil, err
+	}
+	return &env, nil
+}
+
+// Recover removes a corrupt tail left behind by a crash mid-write, as the first append does,
+// and reports it with LastRecovery. A process that reads the log before appending to it,
+// e.g. to load the game, calls Recover first; other readers leave the log as it is.
+func (fs *FileEventStore) Recover() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.closed {
+		return events.ErrClosed
+	}
+	return fs.recoverLocked()
+}
+
+// recoverLocked scans the log once and removes a corrupt tail left behind by a torn write.
+// Corruption followed by valid records is not a torn write and is reported as an error.
+// Only the active segment is checked; sealed segments were synced when they were sealed.
+// The caller must hold fs.mu.
+func (fs *FileEventStore) recoverLocked() error {
+	if fs.recovered {
+		return nil
+	}
+	active, err := fs.activeSegmentLocked()
+	if err != nil {
+		return err
+	}
+	path := active.path
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open event store file: %w", err)
+	}
+	defer file.Close()
+
+	format, _, err := detectFormat(path)
+	if err != nil {
+		return fmt.Errorf("failed to read event store file: %w", err)
+	}
+	codec := codecFor(format)
+	header := int64(len(codec.header()))
+	if _, err := file.Seek(header, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek event store file: %w", err)
+	}
+
+	offset, goodEnd := header, header
+	badAt := int64(-1)
+	reader := bufio.NewReader(file)
+	for {
+		_, n, err := codec.next(reader)
+		if err == io.EOF {
+			offset += int64(n)
+			break
+		}
+		if err != nil && !stderrors.Is(err, errCorruptRecord) {
+			return fmt.Errorf("error reading event store file: %w", err)
+		}
+		if err != nil {
+			if badAt < 0 {
+				badAt = offset
+			}
+		} else if badAt >= 0 {
+			return errors.NewGameError(errors.ErrCorruptEventLog, fmt.Sprintf("corrupt record at byte %d of %s is followed by valid records", badAt, path))
+		} else {
+			goodEnd = offset + int64(n)
+		}
+		offset += int64(n)
+	}
+
+	if badAt >= 0 {
+		tail := make([]byte, offset-goodEnd)
+		if _, err := file.ReadAt(tail, goodEnd); err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read corrupt tail: %w", err)
+		}
+		report := &RecoveryReport{Offset: goodEnd, Bytes: int64(len(tail))}
+		if fs.opts.Recovery == RecoverQuarantine {
+			report.QuarantinePath = fmt.Sprintf("%s.corrupt-%d", path, time.Now().UnixNano())
+			if err := os.WriteFile(report.QuarantinePath, tail, 0644); err != nil {
+				return fmt.Errorf("failed to quarantine corrupt tail: %w", err)
+			}
+		}
+		if err := file.Truncate(goodEnd); err != nil {
+			return fmt.Errorf("failed to truncate corrupt tail: %w", err)
+		}
+		log.Printf("Recovered event log %s: removed %d corrupt bytes at offset %d", path, report.Bytes, report.Offset)
+		fs.recovery = report
+	} else if format == FormatJSON && offset > 0 {
+		// The last record may be intact but have lost its newline; restore it so the next append starts a new line.
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, offset-1); err != nil {
+			return fmt.Errorf("failed to read event store file: %w", err)
+		}
+		if last[0] != '\n' {
+			if _, err := file.WriteAt([]byte{'\n'}, offset); err != nil {
+				return fmt.Errorf("failed to terminate last record: %w", err)
+			}
+		}
+	}
+
+	fs.recovered = true
+	return nil
+}
+
+// LastRecovery reports the corrupt tail removed when the log was opened for appending, or nil if there was none.
+func (fs *FileEventStore) LastRecovery() *RecoveryReport {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.recovery
+}
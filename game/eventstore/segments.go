@@ -0,0 +1,369 @@
+package eventstore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"clicker2/game/events"
+)
+
+// DefaultIndexEvery is the number of records between two index entries within a segment.
+const DefaultIndexEvery = 1000
+
+// segment is one file of a segmented log.
+type segment struct {
+	number int
+	path   string
+}
+
+// indexEntry locates a record: the record with sequence Sequence starts at byte Offset of segment Segment.
+type indexEntry struct {
+	Sequence uint64
+	Segment  int
+	Offset   int64
+}
+
+// segmented reports whether the store splits the log into segments.
+func (fs *FileEventStore) segmented() bool {
+	return fs.opts.SegmentSize > 0
+}
+
+// segmentBase splits the log path into the prefix and extension used for segment names.
+// A log at "events.log" is stored as "events-000001.log", "events-000002.log" and so on.
+func (fs *FileEventStore) segmentBase() (prefix, ext string) {
+	ext = filepath.Ext(fs.filePath)
+	if ext == "" {
+		ext = ".log"
+	}
+	return strings.TrimSuffix(fs.filePath, filepath.Ext(fs.filePath)), ext
+}
+
+func (fs *FileEventStore) segmentPath(number int) string {
+	prefix, ext := fs.segmentBase()
+	return fmt.Sprintf("%s-%06d%s", prefix, number, ext)
+}
+
+// indexPath returns the path of the segment index, "events.idx" for a log at "events.log".
+func (fs *FileEventStore) indexPath() string {
+	prefix, _ := fs.segmentBase()
+	return prefix + ".idx"
+}
+
+// segments lists the files of the log in order. Without segmentation it is just the log file.
+func (fs *FileEventStore) segments() ([]segment, error) {
+	if !fs.segmented() {
+		return []segment{{path: fs.filePath}}, nil
+	}
+	prefix, ext := fs.segmentBase()
+	paths, err := filepath.Glob(prefix + "-*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	var segments []segment
+	for _, path := range paths {
+		number, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(path, prefix+"-"), ext))
+		if err != nil || number <= 0 {
+			continue // Not one of ours, e.g. a quarantined tail
+		}
+		segments = append(segments, segment{number: number, path: path})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].number < segments[j].number })
+	if len(segments) == 0 {
+		// A log written without segmentation is read as the first segment until it is appended to.
+		if _, err := os.Stat(fs.filePath); err == nil {
+			segments = append(segments, segment{number: 1, path: fs.filePath})
+		}
+	}
+	return segments, nil
+}
+
+// Exists reports whether any file of the log exists, so that tools can tell a missing log from an empty one.
+func (fs *FileEventStore) Exists() (bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	segments, err := fs.segments()
+	if err != nil {
+		return false, fmt.Errorf("failed to list event log segments: %w", err)
+	}
+	for _, s := range segments {
+		if _, err := os.Stat(s.path); err == nil {
+			return true, nil
+		} else if !os.IsNotExist(err) {
+			return false, fmt.Errorf("failed to stat event store file: %w", err)
+		}
+	}
+	return false, nil
+}
+
+// activeSegmentLocked returns the segment new records are appended to, creating the first one if needed.
+// A log written before segmentation was enabled becomes the first segment.
+// The caller must hold fs.mu.
+func (fs *FileEventStore) activeSegmentLocked() (segment, error) {
+	if !fs.segmented() {
+		return segment{path: fs.filePath}, nil
+	}
+	segments, err := fs.segments()
+	if err != nil {
+		return segment{}, err
+	}
+	if n := len(segments); n > 0 && segments[n-1].path != fs.filePath {
+		return segments[n-1], nil
+	}
+	first := segment{number: 1, path: fs.segmentPath(1)}
+	if _, err := os.Stat(fs.filePath); err == nil {
+		if err := os.Rename(fs.filePath, first.path); err != nil {
+			return segment{}, fmt.Errorf("failed to move event log into first segment: %w", err)
+		}
+	}
+	return first, nil
+}
+
+// SealedSegments returns the paths of the segments that are no longer appended to, oldest first.
+// They are never modified by the store again except by Compact, so they can be archived or
+// compressed. Records in segments that were moved away are no longer read.
+// Without segmentation there are no sealed segments.
+func (fs *FileEventStore) SealedSegments() ([]string, error) {
+	if !fs.segmented() {
+		return nil, nil
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	segments, err := fs.segments()
+	if err != nil || len(segments) == 0 {
+		return nil, err
+	}
+	var paths []string
+	for _, s := range segments[:len(segments)-1] {
+		paths = append(paths, s.path)
+	}
+	return paths, nil
+}
+
+// prepareAppendLocked rotates to a new segment if a record of n bytes would overflow the active one,
+// and adds an index entry for the record if one is due. The caller must hold fs.mu.
+func (fs *FileEventStore) prepareAppendLocked(sequence uint64, n int64) error {
+	if header := int64(len(codecFor(fs.opts.Format).header())); fs.activeSize > header && fs.activeSize+n > fs.opts.SegmentSize {
+		if err := fs.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	if fs.sinceIndex >= fs.indexEvery() {
+		if err := fs.appendIndex(indexEntry{Sequence: sequence, Segment: fs.active.number, Offset: fs.activeSize}); err != nil {
+			return err
+		}
+		fs.sinceIndex = 0
+	}
+	fs.sinceIndex++
+	return nil
+}
+
+func (fs *FileEventStore) indexEvery() int {
+	if fs.opts.IndexEvery > 0 {
+		return fs.opts.IndexEvery
+	}
+	return DefaultIndexEvery
+}
+
+// rotateLocked seals the active segment and starts the next one, compacting the sealed
+// segment in the background with CompactSealed. The caller must hold fs.mu.
+func (fs *FileEventStore) rotateLocked() error {
+	if err := fs.syncLocked(); err != nil {
+		return err
+	}
+	if err := fs.file.Close(); err != nil {
+		return fmt.Errorf("failed to close event log segment: %w", err)
+	}
+	if fs.opts.CompactSealed {
+		fs.compacting.Add(1)
+		go fs.compactSealed(fs.active)
+	}
+	next := segment{number: fs.active.number + 1, path: fs.segmentPath(fs.active.number + 1)}
+	file, err := os.OpenFile(next.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fs.file, fs.writer = nil, nil
+		return fmt.Errorf("failed to open event log segment: %w", err)
+	}
+	fs.file = file
+	fs.writer.Reset(file)
+	fs.active = next
+	fs.activeSize = 0
+	fs.writeHeaderLocked()
+	fs.sinceIndex = fs.indexEvery() // Every segment starts with an index entry
+	return nil
+}
+
+// readIndex loads the segment index. A missing index is empty.
+func (fs *FileEventStore) readIndex() ([]indexEntry, error) {
+	file, err := os.Open(fs.indexPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []indexEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry indexEntry
+		if _, err := fmt.Sscanf(scanner.Text(), "%d %d %d", &entry.Sequence, &entry.Segment, &entry.Offset); err != nil {
+			continue // The index is only a hint; a torn entry is ignored
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// appendIndex adds an entry to the segment index.
+func (fs *FileEventStore) appendIndex(entry indexEntry) error {
+	file, err := os.OpenFile(fs.indexPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open event log index: %w", err)
+	}
+	_, err = fmt.Fprintf(file, "%d %d %d\n", entry.Sequence, entry.Segment, entry.Offset)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write event log index: %w", err)
+	}
+	return nil
+}
+
+// writeIndex replaces the segment index with entries.
+func (fs *FileEventStore) writeIndex(entries []indexEntry) error {
+	var b strings.Builder
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "%d %d %d\n", entry.Sequence, entry.Segment, entry.Offset)
+	}
+	tmp := fs.indexPath() + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write event log index: %w", err)
+	}
+	return os.Rename(tmp, fs.indexPath())
+}
+
+// pruneIndexLocked drops index entries pointing past the end of the active segment.
+// They are left behind when buffered records were lost in a crash or a torn tail was removed,
+// and would otherwise hide the records appended in their place. The caller must hold fs.mu.
+func (fs *FileEventStore) pruneIndexLocked() error {
+	entries, err := fs.readIndex()
+	if err != nil {
+		return err
+	}
+	kept := entries[:0]
+	for _, entry := range entries {
+		if entry.Segment < fs.active.number || (entry.Segment == fs.active.number && entry.Offset < fs.activeSize) {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) == len(entries) {
+		return nil
+	}
+	return fs.writeIndex(kept)
+}
+
+// segmentRange is the part of a segment a reader has to scan.
+type segmentRange struct {
+	path         string
+	file         os.FileInfo // Identifies the planned file, nil if unknown
+	offset, size int64
+	lastSequence uint64 // Sequence of the record before offset, used to number legacy records
+}
+
+// planLocked returns the parts of the log holding the records from sequence from onwards.
+// The index is used to skip whole segments and seek into the first one.
+// The caller must hold fs.mu.
+func (fs *FileEventStore) planLocked(from uint64) ([]segmentRange, error) {
+	segments, err := fs.segments()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list event log segments: %w", err)
+	}
+
+	var start indexEntry
+	if fs.segmented() && from > 1 {
+		entries, err := fs.readIndex()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read event log index: %w", err)
+		}
+		exists := make(map[int]bool, len(segments))
+		for _, s := range segments {
+			exists[s.number] = true
+		}
+		for _, entry := range entries {
+			if entry.Sequence <= from && entry.Sequence >= start.Sequence && exists[entry.Segment] {
+				start = entry
+			}
+		}
+	}
+
+	var plan []segmentRange
+	for _, s := range segments {
+		if s.number < start.Segment {
+			continue
+		}
+		info, err := os.Stat(s.path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat event store file: %w", err)
+		}
+		r := segmentRange{path: s.path, file: info, size: info.Size()}
+		if s.number == start.Segment && start.Sequence > 0 {
+			r.offset, r.lastSequence = start.Offset, start.Sequence-1
+		}
+		plan = append(plan, r)
+	}
+	return plan, nil
+}
+
+// readPlan streams the records in plan with a sequence of at least from to fn.
+func readPlan(plan []segmentRange, from uint64, fn func(record *events.Record) error) error {
+	var lastSequence uint64
+	for _, r := range plan {
+		if r.lastSequence > lastSequence {
+			lastSequence = r.lastSequence
+		}
+		stopped, gerr := readSegment(r, from, &lastSequence, fn)
+		if gerr != nil || stopped {
+			return gerr
+		}
+	}
+	return nil
+}
+
+func readSegment(r segmentRange, from uint64, lastSequence *uint64, fn func(record *events.Record) error) (bool, error) {
+	file, err := os.Open(r.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open event store file: %w", err)
+	}
+	defer file.Close()
+	if r.file != nil {
+		if info, err := file.Stat(); err == nil && !os.SameFile(info, r.file) {
+			// The segment was compacted since the read was planned and its offsets changed,
+			// so the whole new file is read and records before from are skipped by sequence.
+			r.offset, r.size = 0, info.Size()
+		}
+	}
+	format, _, err := detectFormat(r.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read event store file: %w", err)
+	}
+	codec := codecFor(format)
+	offset := r.offset
+	if header := int64(len(codec.header())); offset < header {
+		offset = header
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return false, fmt.Errorf("failed to seek event store file: %w", err)
+	}
+	return readRecords(io.LimitReader(file, r.size-offset), codec, from, lastSequence, fn)
+}
@@ -0,0 +1,199 @@
+package eventstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	stderrors "errors"
+	"fmt"
+	"sync"
+
+	"clicker2/game/errors"
+	"clicker2/game/events"
+)
+
+// ErrTampered matches, with errors.Is, the error returned for a signed log whose records do not match their MACs.
+var ErrTampered = errors.NewGameError(errors.ErrTamperedEventLog)
+
+// SignedEventStore wraps another events.EventStore and chains its records with an HMAC-SHA256:
+// each record's MAC covers its metadata, its payload and the MAC of the record before it,
+// so editing, reordering, inserting or removing a record breaks every MAC after it.
+// Removing records from the end of the log cannot be detected by the chain alone.
+// A record the inner store cannot read, e.g. one edited without updating its checksum,
+// is reported as tampering too.
+//
+// Records are verified once: the store remembers the last verified record and its MAC,
+// and later reads, whatever their starting sequence, only check the records after it.
+// A log whose records are not in sequence order is verified from the first record every time.
+// The MAC covers the payload at the schema version it is read with, so a log must be
+// re-signed, e.g. by converting it from the unwrapped store, after an upcaster is added.
+type SignedEventStore struct {
+	inner events.EventStore
+	key   []byte
+
+	mu    sync.Mutex    // Serializes appends so the chain follows the log order, and protects the fields below
+	ids   *events.Dedup // Event IDs in the log, nil until the first append has read the log
+	chain chainState    // Verified prefix of the log, and the end of the log once ids is set
+}
+
+// chainState is how far the chain of MACs has been verified.
+type chainState struct {
+	verified  uint64 // Sequence of the last record known to match its MAC, 0 if none
+	last      string // MAC of that record
+	unordered bool   // Records are out of sequence order, so verified cannot tell which ones were checked
+}
+
+// NewSignedEventStore signs the records appended to inner with key.
+func NewSignedEventStore(inner events.EventStore, key []byte) *SignedEventStore {
+	return &SignedEventStore{inner: inner, key: key}
+}
+
+// Append signs a record, chained to the last record of the log, and appends it to the inner store.
+// The first append verifies the rest of the existing log. Records whose event ID is already in the
+// log are dropped here, before they are signed, so the inner store never breaks the chain by dropping one.
+func (ss *SignedEventStore) Append(record *events.Record) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.ids == nil {
+		ids := events.NewDedup()
+		err := ss.verify(0, ss.chain, func(c chainState) { ss.chain = c }, func(record *events.Record) error {
+			ids.Add(record)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		ss.ids = ids
+	}
+	if ss.ids.Duplicate(record) {
+		return nil
+	}
+
+	mac, err := ss.mac(ss.chain.last, record)
+	if err != nil {
+		return err
+	}
+	signed := *record
+	signed.MAC = mac
+	if err := ss.inner.Append(&signed); err != nil {
+		return err
+	}
+	ss.ids.Add(record)
+	if record.Sequence <= ss.chain.verified {
+		ss.chain.unordered = true
+	}
+	ss.chain.verified, ss.chain.last = record.Sequence, mac
+	return nil
+}
+
+// ReadFrom verifies the log and streams the records with a sequence number of at least from to fn.
+// It fails with an error matching ErrTampered at the first record that does not match its MAC,
+// after passing fn the verified records before it.
+func (ss *SignedEventStore) ReadFrom(from uint64, fn func(record *events.Record) error) error {
+	ss.mu.Lock()
+	c := ss.chain
+	ss.mu.Unlock()
+	// fn may append, so the lock is only taken to remember newly verified records.
+	return ss.verify(from, c, func(c chainState) {
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		switch {
+		case ss.chain.unordered:
+		case c.unordered:
+			ss.chain.unordered = true // Appends keep track of the end of the log themselves
+		case c.verified > ss.chain.verified:
+			ss.chain.verified, ss.chain.last = c.verified, c.last
+		}
+	}, fn)
+}
+
+// Verify checks the whole log against its MACs, failing with an error matching ErrTampered
+// at the first record that does not match. Call it when opening a log so tampering is reported
+// up front; later reads and appends only check the records added since.
+func (ss *SignedEventStore) Verify() error {
+	return ss.ReadFrom(0, func(*events.Record) error { return nil })
+}
+
+// verify reads the log from sequence from, or from the first record after the verified prefix c
+// if that is earlier, and checks the records after that prefix against the chain. The state after
+// every record that matches its MAC is passed to remember; records from sequence from on are passed to fn.
+func (ss *SignedEventStore) verify(from uint64, c chainState, remember func(c chainState), fn func(record *events.Record) error) error {
+	start := c.verified + 1
+	if c.unordered {
+		c, start = chainState{unordered: true}, 0
+	} else if from < start {
+		start = from
+	}
+	checked := false
+	err := ss.inner.ReadFrom(start, func(record *events.Record) error {
+		if checked && record.Sequence <= c.verified {
+			c.unordered = true
+		}
+		if c.unordered || record.Sequence > c.verified {
+			want, err := ss.mac(c.last, record)
+			if err != nil {
+				return err
+			}
+			if !hmac.Equal([]byte(record.MAC), []byte(want)) {
+				return errors.NewGameError(errors.ErrTamperedEventLog, fmt.Sprintf("record %d does not match its signature", record.Sequence))
+			}
+			checked = true
+			c.verified, c.last = record.Sequence, record.MAC
+			remember(c)
+		}
+		if record.Sequence < from {
+			return nil
+		}
+		return fn(record)
+	})
+	if stderrors.Is(err, ErrCorrupt) && !stderrors.Is(err, ErrTampered) {
+		return errors.WrapGameError(errors.ErrTamperedEventLog, err, fmt.Sprintf("record after %d does not match its checksum", c.verified))
+	}
+	return err
+}
+
+// mac returns the MAC of a record chained to the MAC of the record before it.
+func (ss *SignedEventStore) mac(previous string, record *events.Record) (string, error) {
+	env, err := events.EncodeRecord(record)
+	if err != nil {
+		return "", err
+	}
+	h := hmac.New(sha256.New, ss.key)
+	var buf []byte
+	buf = appendString(buf, previous)
+	buf = binary.AppendUvarint(buf, env.Sequence)
+	buf = binary.AppendVarint(buf, env.Timestamp.UnixNano())
+	buf = appendString(buf, env.EventID)
+	buf = appendString(buf, env.SessionID)
+	buf = appendString(buf, env.Type)
+	buf = binary.AppendUvarint(buf, uint64(env.Version))
+	buf = appendString(buf, string(env.Data))
+	h.Write(buf)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// LastSequence returns the highest sequence number in the underlying store without checking signatures.
+func (ss *SignedEventStore) LastSequence() (uint64, error) {
+	return events.LastSequence(ss.inner)
+}
+
+// Duplicates returns the number of records dropped by Append because the log already held their event ID.
+func (ss *SignedEventStore) Duplicates() int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.ids == nil {
+		return 0
+	}
+	return ss.ids.Dropped()
+}
+
+// Flush flushes the inner store.
+func (ss *SignedEventStore) Flush() error {
+	return ss.inner.Flush()
+}
+
+// Close closes the inner store.
+func (ss *SignedEventStore) Close() error {
+	return ss.inner.Close()
+}
@@ -0,0 +1,226 @@
+package eventstore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"time"
+
+	"clicker2/game/events"
+)
+
+// openWriterLocked opens the log for appending on first use and starts the flush timer.
+// The caller must hold fs.mu.
+func (fs *FileEventStore) openWriterLocked() error {
+	if fs.closed {
+		return events.ErrClosed
+	}
+	if fs.file != nil {
+		return nil
+	}
+	if gerr := fs.recoverLocked(); gerr != nil {
+		return gerr
+	}
+
+	active, err := fs.activeSegmentLocked()
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(active.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open event store file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat event store file: %w", err)
+	}
+	if info.Size() > 0 {
+		format, _, err := detectFormat(active.path)
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("failed to read event store file: %w", err)
+		}
+		if format != fs.opts.Format {
+			file.Close()
+			return fmt.Errorf("event log %s is in %s format, not %s; convert it first", active.path, format, fs.opts.Format)
+		}
+	}
+	fs.file = file
+	fs.writer = bufio.NewWriter(file)
+	fs.active, fs.activeSize = active, info.Size()
+	fs.writeHeaderLocked()
+	if fs.segmented() {
+		fs.sinceIndex = fs.indexEvery() // Index the first record appended by this writer
+		if err := fs.pruneIndexLocked(); err != nil {
+			return err
+		}
+	}
+
+	if fs.opts.FlushInterval > 0 {
+		fs.stop = make(chan struct{})
+		go fs.flushPeriodically(fs.opts.FlushInterval, fs.stop)
+	}
+	return nil
+}
+
+// writeHeaderLocked starts an empty file with the header of the store's format.
+// The caller must hold fs.mu.
+func (fs *FileEventStore) writeHeaderLocked() {
+	if fs.activeSize > 0 {
+		return
+	}
+	header := codecFor(fs.opts.Format).header()
+	fs.writer.Write(header) // Errors are sticky and reported by the next write
+	fs.activeSize += int64(len(header))
+}
+
+// flushPeriodically flushes the buffer, and syncs if the policy asks for it, until stop is closed.
+// A failed flush is reported by the next Append or Flush.
+func (fs *FileEventStore) flushPeriodically(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			fs.mu.Lock()
+			select {
+			case <-stop: // Stopped while waiting for the lock; the file may be closed or replaced
+				fs.mu.Unlock()
+				return
+			default:
+			}
+			var err error
+			if fs.syncDueLocked() {
+				err = fs.syncLocked()
+			} else {
+				err = fs.flushLocked()
+			}
+			if err != nil && fs.flushErr == nil {
+				fs.flushErr = err
+			}
+			fs.mu.Unlock()
+		}
+	}
+}
+
+// takeFlushErrLocked returns and clears the error of a failed flush by the timer.
+// The caller must hold fs.mu.
+func (fs *FileEventStore) takeFlushErrLocked() error {
+	err := fs.flushErr
+	fs.flushErr = nil
+	return err
+}
+
+// takeCompactErrLocked returns and clears the error of a failed background compaction.
+// The caller must hold fs.mu.
+func (fs *FileEventStore) takeCompactErrLocked() error {
+	err := fs.compactErr
+	fs.compactErr = nil
+	return err
+}
+
+// flushLocked writes buffered records to the file. The caller must hold fs.mu.
+func (fs *FileEventStore) flushLocked() error {
+	if fs.writer == nil || fs.pending == 0 {
+		return nil
+	}
+	if err := fs.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush event store file: %w", err)
+	}
+	fs.pending = 0
+	return nil
+}
+
+// syncDueLocked reports whether the sync policy asks for a sync now. The caller must hold fs.mu.
+func (fs *FileEventStore) syncDueLocked() bool {
+	if fs.unsynced == 0 {
+		return false
+	}
+	policy := fs.opts.Sync
+	switch policy.Mode {
+	case SyncAlways:
+		return true
+	case SyncEveryN:
+		return fs.unsynced >= policy.Every
+	case SyncInterval:
+		return time.Since(fs.lastSync) >= policy.Interval
+	}
+	return false
+}
+
+// syncLocked flushes buffered records and forces the file to stable storage.
+// The caller must hold fs.mu.
+func (fs *FileEventStore) syncLocked() error {
+	if err := fs.flushLocked(); err != nil {
+		return err
+	}
+	if fs.file == nil {
+		return nil
+	}
+	if err := fs.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync event store file: %w", err)
+	}
+	fs.unsynced = 0
+	fs.lastSync = time.Now()
+	return nil
+}
+
+// closeWriterLocked stops the flush timer, syncs and closes the file.
+// The store reopens the file on the next append. The caller must hold fs.mu.
+func (fs *FileEventStore) closeWriterLocked() error {
+	if fs.file == nil {
+		return nil
+	}
+	if fs.stop != nil {
+		// The timer may be waiting for the lock we hold; it checks stop once it gets it.
+		close(fs.stop)
+		fs.stop = nil
+	}
+	err := fs.takeFlushErrLocked()
+	if syncErr := fs.syncLocked(); err == nil {
+		err = syncErr
+	}
+	if closeErr := fs.file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to close event store file: %w", closeErr)
+	}
+	fs.file, fs.writer = nil, nil
+	return err
+}
+
+// Flush writes buffered records to the file.
+func (fs *FileEventStore) Flush() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.takeFlushErrLocked(); err != nil {
+		return err
+	}
+	if err := fs.takeCompactErrLocked(); err != nil {
+		return err
+	}
+	return fs.flushLocked()
+}
+
+// Close flushes and syncs buffered records, closes the file and waits for background compactions.
+// Appending to a closed store fails with events.ErrClosed; reading is still possible.
+func (fs *FileEventStore) Close() error {
+	fs.mu.Lock()
+	if fs.closed {
+		fs.mu.Unlock()
+		return nil
+	}
+	fs.closed = true
+	err := fs.closeWriterLocked()
+	fs.mu.Unlock()
+
+	// Compactions take fs.mu to move the compacted segment into place.
+	fs.compacting.Wait()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if compactErr := fs.takeCompactErrLocked(); err == nil {
+		err = compactErr
+	}
+	return err
+}
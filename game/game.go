@@ -1,14 +1,17 @@
 package game
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"os"
 	"fmt"
 	"math/rand" // Added for random message selection
 	"log" // Added for logging game endings
+	"math"
 
 	"clicker2/game/events"
-	"clicker2/game/eventstore"
 	"clicker2/game/errors" // Import the new errors package
 )
 
@@ -18,6 +21,10 @@ var OsExit = os.Exit
 const InitialRockHealth = 10000000
 var SaveFile = "save.json" // Exported for testing
 
+// SaveKey signs the save file when set: SaveToFile writes an HMAC of the file next to it,
+// with a ".sig" suffix, and LoadFromFile refuses a save file without a matching signature.
+var SaveKey []byte
+
 // Save serializes the game state to a file.
 func (g *Game) Save() error {
 	return g.SaveToFile(SaveFile)
@@ -29,7 +36,24 @@ func (g *Game) SaveToFile(path string) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, data, 0644)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	if SaveKey == nil {
+		// A signature left over from a signed save no longer matches.
+		if err := os.Remove(path + ".sig"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(path+".sig", []byte(signSave(data)), 0644)
+}
+
+// signSave returns the hex-encoded HMAC of a save file's contents under SaveKey.
+func signSave(data []byte) string {
+	h := hmac.New(sha256.New, SaveKey)
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
 }
 
 // Rock represents the entity that is clicked.
@@ -54,15 +78,25 @@ type Game struct {
 	CurrentRockMessage string
 	RockMessageTimer   float64 // Duration for which the message is displayed
 	RockMessages       []string
-	EndGameChoicePending bool
+	Phase                Phase // Decides which commands are allowed, see setPhase
+	EndGameChoicePending bool  // Mirrors Phase, like GameOver and GameWon
 	GameOver             bool
 	GameWon              bool
 	ShouldExit           bool // New field to signal game termination
+
+	store            events.EventStore // Where the dispatcher persists events, may be nil
+	snapshots        *SnapshotStore    // Optional, see EnableSnapshots
+	snapshotInterval uint64
+	lastSnapshot     uint64              // Sequence of the last snapshot written
+	readOnly         bool                // Set for games rebuilt by a Timeline, which must not touch the save file
+	applied          *events.Dedup       // IDs of the events applied to the game, see ReplayEvents
+	refundWindow     RefundWindow        // See SetRefundWindow
+	lastPurchase     *refundablePurchase // The purchase RefundLastPurchase would undo, nil if none
 }
 
-// NewGame creates a new game state with initial values.
-func NewGame() *Game {
-	es := eventstore.NewFileEventStore("events.log") // Initialize FileEventStore
+// NewGame creates a new game state with initial values whose events are persisted to es.
+// A nil es keeps nothing, e.g. for games that are only replayed.
+func NewGame(es events.EventStore) *Game {
 	g := &Game{
 		TheRock: &Rock{
 			Health: InitialRockHealth,
@@ -84,20 +118,36 @@ func NewGame() *Game {
 			"A tiny shard breaks off, almost imperceptibly.",
 			"You hear a soft, distant sigh.",
 		},
+		Phase:                PhasePlaying,
 		EndGameChoicePending: false,
 		GameOver:             false,
 		GameWon:              false,
 		ShouldExit:           false, // Initialize ShouldExit to false
+		store:                es,
+		applied:              events.NewDedup(),
+		refundWindow:         DefaultRefundWindow,
 	}
 	g.Dispatcher.Register("Click", g.ApplyClickEvent)
+	g.Dispatcher.Register("ClicksAggregated", g.ApplyClicksAggregatedEvent)
 	g.Dispatcher.Register("UpgradePurchased", g.ApplyUpgradePurchasedEvent)
 	g.Dispatcher.Register("HeartTaken", g.ApplyHeartTaken)
 	g.Dispatcher.Register("MountainRested", g.ApplyMountainRested)
+	g.Dispatcher.Register("PurchaseRefunded", g.ApplyPurchaseRefunded)
+	g.Dispatcher.Subscribe(events.OfType("UpgradePurchased", "Click", "ClicksAggregated", "PurchaseRefunded", "HeartTaken", "MountainRested"), g.trackRefundWindow)
+	// Subscribed last, so only events every handler accepted count as applied
+	g.Dispatcher.Subscribe(events.AllEvents(), func(record *events.Record) error {
+		g.applied.Add(record)
+		return nil
+	})
 	return g
 }
 
 // Click handles the logic for a single click on the rock.
-func (g *Game) Click() {
+// It returns an error, and leaves the game unchanged, if the click could not be recorded.
+func (g *Game) Click() *errors.GameError {
+	if err := g.requirePlaying(); err != nil {
+		return err
+	}
 	rockHealthBefore := g.TheRock.Health
 	playerDustBefore := g.ThePlayer.Dust
 
@@ -105,7 +155,7 @@ func (g *Game) Click() {
 	dustGained := 1
 
 	// Dispatch event
-	g.Dispatcher.Dispatch(&events.ClickEvent{
+	if err := g.dispatch(&events.ClickEvent{
 		PlayerID: "player1", // Placeholder
 		DamageDealt: damageDealt,
 		DustGained: dustGained,
@@ -113,7 +163,9 @@ func (g *Game) Click() {
 		RockHealthAfter: rockHealthBefore - damageDealt,
 		PlayerDustBefore: playerDustBefore,
 		PlayerDustAfter: playerDustBefore + dustGained,
-	})
+	}); err != nil {
+		return err
+	}
 
 	// Trigger a rock message
 	if len(g.RockMessages) > 0 {
@@ -121,6 +173,18 @@ func (g *Game) Click() {
 		g.CurrentRockMessage = g.RockMessages[randomIndex]
 		g.RockMessageTimer = 3.0 // Display message for 3 seconds
 	}
+	return nil
+}
+
+// dispatch dispatches an event produced by a player action and takes a snapshot when one is due.
+// The event changes the game state through its handler, so a failed dispatch leaves the state
+// as it was unless the dispatcher applies events before persisting them.
+func (g *Game) dispatch(event events.Event) *errors.GameError {
+	if err := g.Dispatcher.Dispatch(event); err != nil {
+		return errors.WrapGameError(errors.ErrDispatchFailed, err)
+	}
+	g.maybeSnapshot()
+	return nil
 }
 
 // ApplyClickEvent applies the state changes from a ClickEvent.
@@ -131,6 +195,14 @@ func (g *Game) ApplyClickEvent(event events.Event) {
 	}
 }
 
+// ApplyClicksAggregatedEvent applies the state changes from a ClicksAggregatedEvent.
+func (g *Game) ApplyClicksAggregatedEvent(event events.Event) {
+	if e, ok := event.(*events.ClicksAggregatedEvent); ok {
+		g.TheRock.Health = e.RockHealthAfter
+		g.ThePlayer.Dust = e.PlayerDustAfter
+	}
+}
+
 // ApplyUpgradePurchasedEvent applies the state changes from an UpgradePurchasedEvent.
 func (g *Game) ApplyUpgradePurchasedEvent(event events.Event) {
 	if e, ok := event.(*events.UpgradePurchasedEvent); ok {
@@ -155,7 +227,7 @@ func (g *Game) ApplyHeartTaken(event events.Event) {
 		g.TheRock.Health = 0 // Shatter the rock
 		g.CurrentRockMessage = "The mountain is no more. You are alone with your dust."
 		g.RockMessageTimer = -1.0 // Display indefinitely
-		g.GameOver = true
+		g.setPhase(PhaseLost)
 		// In a real game, you might show a final screen before exiting.
 		g.ShouldExit = true // Signal main loop to terminate
 	}
@@ -167,10 +239,12 @@ func (g *Game) ApplyMountainRested(event events.Event) {
 		log.Println("Good Ending: You let the Heart of the Mountain rest.")
 		g.CurrentRockMessage = "The rock is at peace. You have won."
 		g.RockMessageTimer = -1.0 // Display indefinitely
-		g.GameWon = true
+		g.setPhase(PhaseWon)
 		// Save the game in its "won" state
-		if err := g.Save(); err != nil {
-			log.Printf("Error saving game after winning: %v", err)
+		if !g.readOnly {
+			if err := g.Save(); err != nil {
+				log.Printf("Error saving game after winning: %v", err)
+			}
 		}
 		// In a real game, you might show a final screen before exiting.
 		g.ShouldExit = true // Signal main loop to terminate
@@ -179,6 +253,9 @@ func (g *Game) ApplyMountainRested(event events.Event) {
 
 // PurchaseUpgrade handles the logic for purchasing an upgrade.
 func (g *Game) PurchaseUpgrade(upgradeID string) *errors.GameError {
+	if err := g.requirePlaying(); err != nil {
+		return err
+	}
 	upgrade, err := g.Upgrades.GetUpgrade(upgradeID)
 	if err != nil {
 		return err
@@ -193,29 +270,58 @@ func (g *Game) PurchaseUpgrade(upgradeID string) *errors.GameError {
 		return errors.NewGameError(errors.ErrInsufficientDust, "not enough dust to purchase upgrade")
 	}
 
-	g.ThePlayer.Dust -= cost
-	g.Upgrades.PlayerUpgrades[upgradeID]++
-	upgrade.ApplyEffect(g)
-
-	g.Dispatcher.Dispatch(&events.UpgradePurchasedEvent{
+	// The event handler updates the dust, the level and the effect of the upgrade,
+	// so nothing changes unless the purchase is recorded.
+	return g.dispatch(&events.UpgradePurchasedEvent{
 		UpgradeID: upgradeID,
-		NewLevel:  g.Upgrades.PlayerUpgrades[upgradeID],
-		NewDust:   g.ThePlayer.Dust,
+		NewLevel:  g.Upgrades.PlayerUpgrades[upgradeID] + 1,
+		OldDust:   g.ThePlayer.Dust,
+		NewDust:   g.ThePlayer.Dust - cost,
 	})
-
-	return nil
 }
 
-// ReplayEvents takes a slice of events and dispatches them to reconstruct the game state.
-func (g *Game) ReplayEvents(evs []events.Event) {
-	for _, event := range evs {
-		g.Dispatcher.Dispatch(event)
+// ReplayEvents takes a slice of recorded events and replays them to reconstruct the game state.
+// Replayed events are not persisted again. It stops at the first event a handler rejects.
+// Events the game has already applied, recognized by their event ID, are skipped so that
+// resent or merged events never count twice; it returns how many were skipped. Only the IDs
+// of the last events.DefaultDedupWindow applied events are known, so an event applied longer ago
+// is applied again; see SetDedupWindow to merge logs that overlap further back. A game loaded
+// from a snapshot only knows the events that followed the snapshot.
+func (g *Game) ReplayEvents(records []*events.Record) (int, error) {
+	dropped := g.applied.Dropped()
+	for _, record := range records {
+		if err := g.replay(record); err != nil {
+			return g.applied.Dropped() - dropped, err
+		}
 	}
+	return g.applied.Dropped() - dropped, nil
 }
 
+// SetDedupWindow sets how many applied event IDs ReplayEvents remembers, every ID if window is
+// zero or negative. It forgets the IDs applied so far, so it is meant for a new game.
+func (g *Game) SetDedupWindow(window int) {
+	g.applied = events.NewDedupWindow(window)
+}
 
+// replay applies a recorded event unless the game has already applied it, see ReplayEvents.
+func (g *Game) replay(record *events.Record) error {
+	if g.applied.Duplicate(record) {
+		return nil
+	}
+	return g.Dispatcher.Replay(record)
+}
 
-
+// Close waits for asynchronous subscribers to handle the events dispatched so far,
+// then flushes pending events and closes the event store. It should be called when the game exits.
+func (g *Game) Close() error {
+	if err := g.Dispatcher.Close(); err != nil {
+		return err
+	}
+	if g.store == nil {
+		return nil
+	}
+	return g.store.Close()
+}
 
 // Load deserializes the game state from a file.
 func (g *Game) Load() error {
@@ -228,76 +334,89 @@ func (g *Game) LoadFromFile(path string) error {
 	if err != nil {
 		return err
 	}
+	if SaveKey != nil {
+		sig, err := os.ReadFile(path + ".sig")
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if !hmac.Equal(sig, []byte(signSave(data))) {
+			return errors.NewGameError(errors.ErrTamperedSave)
+		}
+	}
 	if err := json.Unmarshal(data, g); err != nil {
 		return err
 	}
 	g.Upgrades.Init() // Re-initialize the upgrades map after loading
+	g.syncPhase()
 	return nil
 }
 
 // LoadGameFromEvents creates a new game instance and replays events from the provided EventStore.
-func LoadGameFromEvents(es eventstore.EventStore) (*Game, *errors.GameError) {
-	// Create a new game instance with an event dispatcher that does NOT save events during replay
-	g := &Game{
-		TheRock: &Rock{
-			Health: InitialRockHealth,
-		},
-		ThePlayer: &Player{
-			Dust:   0,
-			Damage: 1,
-		},
-		Upgrades:   NewUpgradeManager(), // Initialize UpgradeManager
-		Dispatcher: events.NewEventDispatcher(nil), // Pass nil for EventStore during replay
-		AutoClickerActive: false,
-		AutoClickerRate:   0,
-		CurrentRockMessage: "",
-		RockMessageTimer:   0.0,
-		RockMessages: []string{
-			"A gentle hum emanates from within...",
-			"You feel a faint tremor.",
-			"The rock seems... content.",
-			"A tiny shard breaks off, almost imperceptibly.",
-			"You hear a soft, distant sigh.",
-		},
-		EndGameChoicePending: false,
-		GameOver:             false,
-		GameWon:              false,
-		ShouldExit:           false, // Initialize ShouldExit to false
-	}
-	g.Upgrades.Init() // Initialize upgrades
-	g.Dispatcher.Register("Click", g.ApplyClickEvent)
-	g.Dispatcher.Register("UpgradePurchased", g.ApplyUpgradePurchasedEvent)
-	g.Dispatcher.Register("HeartTaken", g.ApplyHeartTaken)
-	g.Dispatcher.Register("MountainRested", g.ApplyMountainRested)
-
-	// Load all events from the event store
-	loadedEvents, err := es.LoadEvents()
-	if err != nil {
-		return nil, errors.NewGameError(errors.ErrUnknown, fmt.Sprintf("failed to load events from event store: %v", err))
-	}
-
-	// Replay the events to reconstruct the game state
-	g.ReplayEvents(loadedEvents)
+// New events dispatched by the returned game are appended to the same store.
+func LoadGameFromEvents(es events.EventStore) (*Game, *errors.GameError) {
+	return LoadGameFromSnapshot(es, nil)
+}
 
-	// After replay, set up the dispatcher to save new events
-	g.Dispatcher = events.NewEventDispatcher(es) // Re-initialize with the actual EventStore
-	g.Dispatcher.Register("Click", g.ApplyClickEvent)
-	g.Dispatcher.Register("UpgradePurchased", g.ApplyUpgradePurchasedEvent)
+// LoadGameFromSnapshot is like LoadGameFromEvents, but starts from the newest valid snapshot in ss
+// and replays only the events that follow it. A nil ss replays the whole log.
+func LoadGameFromSnapshot(es events.EventStore, ss *SnapshotStore) (*Game, *errors.GameError) {
+	maxSequence := uint64(math.MaxUint64)
+	for {
+		g := NewGame(es)
+		var snapshot *Snapshot
+		if ss != nil {
+			var err error
+			snapshot, err = ss.Latest(maxSequence)
+			if err != nil {
+				return nil, errors.NewGameError(errors.ErrUnknown, fmt.Sprintf("failed to read snapshots: %v", err))
+			}
+		}
 
+		var from uint64
+		if snapshot != nil {
+			if err := g.restore(snapshot); err != nil {
+				return nil, errors.NewGameError(errors.ErrUnknown, fmt.Sprintf("failed to restore snapshot at sequence %d: %v", snapshot.Sequence, err))
+			}
+			from = snapshot.Sequence
+		}
 
-	return g, nil
+		// Stream the events after the snapshot to reconstruct the game state
+		covered := snapshot == nil
+		err := es.ReadFrom(from, func(record *events.Record) error {
+			covered = true
+			if snapshot != nil && record.Sequence <= snapshot.Sequence {
+				return nil // Already part of the snapshot
+			}
+			return g.replay(record)
+		})
+		if err != nil {
+			return nil, errors.WrapGameError(errors.AsGameError(err).Code, err, "failed to load events from event store")
+		}
+		if !covered {
+			// The snapshot is ahead of the log, e.g. after the log was truncated. Try an older one.
+			maxSequence = snapshot.Sequence - 1
+			continue
+		}
+		return g, nil
+	}
 }
 
 // TakeHeart implements the "Bad Ending" logic.
-func (g *Game) TakeHeart() {
-	g.Dispatcher.Dispatch(&events.HeartTakenEvent{
+func (g *Game) TakeHeart() *errors.GameError {
+	if err := g.requireTransition(PhaseLost); err != nil {
+		return err
+	}
+	return g.dispatch(&events.HeartTakenEvent{
 		PlayerID: "player1", // Placeholder
 	})
 }
 
 // LetRest implements the "Good Ending" logic.
-func (g *Game) LetRest() {
-	g.Dispatcher.Dispatch(&events.MountainRestedEvent{
+func (g *Game) LetRest() *errors.GameError {
+	if err := g.requireTransition(PhaseWon); err != nil {
+		return err
+	}
+	return g.dispatch(&events.MountainRestedEvent{
 		PlayerID: "player1", // Placeholder
 	})
 }
@@ -313,9 +432,7 @@ func (g *Game) SetStateEarlyGame() {
 	g.AutoClickerRate = 0
 	g.CurrentRockMessage = ""
 	g.RockMessageTimer = 0.0
-	g.EndGameChoicePending = false
-	g.GameOver = false
-	g.GameWon = false
+	g.setPhase(PhasePlaying)
 	log.Println("Game state set to Early Game.")
 }
 
@@ -1,8 +1,13 @@
 package game_test
 
 import (
+	"bytes"
+	stderrors "errors"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"clicker2/game"
 	"clicker2/game/events"
@@ -11,17 +16,9 @@ import (
 )
 
 func TestGameReplay(t *testing.T) {
-	// Use a temporary file for the event log
-	tempEventLog := "test_events.log"
-	defer os.Remove(tempEventLog) // Clean up after the test
-
-	// Initialize an event store for the original game
-	originalEventStore := eventstore.NewFileEventStore(tempEventLog)
-
-	// Create an original game instance with an event dispatcher that saves events
-	originalGame := game.NewGame()
-	originalGame.Dispatcher = events.NewEventDispatcher(originalEventStore)
-	originalGame.Dispatcher.Register("Click", originalGame.ApplyClickEvent)
+	// Create an original game instance that records its events in memory
+	originalEventStore := eventstore.NewMemoryEventStore()
+	originalGame := game.NewGame(originalEventStore)
 
 	// Perform some actions on the original game
 	// Generate enough dust for the first stronger_pickaxe upgrade (cost 10)
@@ -48,10 +45,15 @@ func TestGameReplay(t *testing.T) {
 	if originalGame.ThePlayer.Damage != replayedGame.ThePlayer.Damage {
 		t.Errorf("Player Damage mismatch: original=%d, replayed=%d", originalGame.ThePlayer.Damage, replayedGame.ThePlayer.Damage)
 	}
+
+	// The replayed game continues numbering after the last logged event.
+	if replayedGame.Dispatcher.LastSequence() != originalGame.Dispatcher.LastSequence() {
+		t.Errorf("Sequence mismatch: original=%d, replayed=%d", originalGame.Dispatcher.LastSequence(), replayedGame.Dispatcher.LastSequence())
+	}
 }
 
 func TestGameCoreMechanics(t *testing.T) {
-	g := game.NewGame()
+	g := game.NewGame(eventstore.NewMemoryEventStore())
 
 	// Test initial state
 	if g.TheRock.Health != game.InitialRockHealth {
@@ -85,7 +87,7 @@ func TestGameCoreMechanics(t *testing.T) {
 }
 
 func TestUpgradeSystem(t *testing.T) {
-	g := game.NewGame()
+	g := game.NewGame(eventstore.NewMemoryEventStore())
 
 	// Test "stronger_pickaxe" purchase
 	g.ThePlayer.Dust = 10 // Enough for first level
@@ -114,7 +116,7 @@ func TestUpgradeSystem(t *testing.T) {
 	}
 
 	// Test "stronger_pickaxe" insufficient dust (after resetting game to ensure not max level)
-	g = game.NewGame() // Reset game state
+	g = game.NewGame(eventstore.NewMemoryEventStore()) // Reset game state
 	g.ThePlayer.Dust = 0
 	err = g.PurchaseUpgrade("stronger_pickaxe")
 	if err == nil || err.Code != errors.ErrInsufficientDust {
@@ -148,8 +150,95 @@ func TestUpgradeSystem(t *testing.T) {
 	}
 }
 
+func TestRefundPurchase(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	store := eventstore.NewMemoryEventStore()
+	g := game.NewGame(store)
+	g.Dispatcher.SetClock(func() time.Time { return now })
+	g.SetRefundWindow(game.RefundWindow{Duration: 10 * time.Second, Clicks: 3})
+
+	if err := g.RefundLastPurchase(); err == nil || err.Code != errors.ErrNotRefundable {
+		t.Errorf("Expected nothing to refund, got %v", err)
+	}
+
+	g.ThePlayer.Dust = 620
+	for _, id := range []string{"auto_clicker_v0_1", "auto_clicker_v1_0"} {
+		if err := g.PurchaseUpgrade(id); err != nil {
+			t.Fatalf("Failed to purchase %s: %v", id, err.Error())
+		}
+	}
+	if err := g.PurchaseUpgrade("stronger_pickaxe"); err != nil {
+		t.Fatalf("Failed to purchase stronger_pickaxe: %v", err.Error())
+	}
+	g.Click()
+	if err := g.RefundLastPurchase(); err != nil {
+		t.Fatalf("Failed to refund stronger_pickaxe: %v", err.Error())
+	}
+	if g.ThePlayer.Dust != 21 || g.ThePlayer.Damage != 1 || g.Upgrades.PlayerUpgrades["stronger_pickaxe"] != 0 {
+		t.Errorf("Refund mismatch: dust %d, damage %d, level %d", g.ThePlayer.Dust, g.ThePlayer.Damage, g.Upgrades.PlayerUpgrades["stronger_pickaxe"])
+	}
+	if err := g.RefundLastPurchase(); err == nil || err.Code != errors.ErrNotRefundable {
+		t.Errorf("Expected a purchase to be refunded only once, got %v", err)
+	}
+
+	// The window closes once Clicks clicks were made or too much time passed.
+	g.ThePlayer.Dust = 1000
+	g.PurchaseUpgrade("stronger_pickaxe")
+	for i := 0; i < 3; i++ {
+		g.Click()
+	}
+	if err := g.RefundLastPurchase(); err == nil || err.Code != errors.ErrRefundWindowClosed {
+		t.Errorf("Expected the click window to be closed, got %v", err)
+	}
+	g.PurchaseUpgrade("stronger_pickaxe")
+	now = now.Add(11 * time.Second)
+	if err := g.RefundLastPurchase(); err == nil || err.Code != errors.ErrRefundWindowClosed {
+		t.Errorf("Expected the time window to be closed, got %v", err)
+	}
+
+	// Replaying the log ends in the same state.
+	records, _ := eventstore.LoadRecords(store)
+	replayed := game.NewGame(nil)
+	if _, err := replayed.ReplayEvents(records); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if replayed.ThePlayer.Dust != g.ThePlayer.Dust || replayed.ThePlayer.Damage != g.ThePlayer.Damage || replayed.Upgrades.PlayerUpgrades["stronger_pickaxe"] != 2 {
+		t.Errorf("Replay mismatch: dust %d, damage %d, level %d", replayed.ThePlayer.Dust, replayed.ThePlayer.Damage, replayed.Upgrades.PlayerUpgrades["stronger_pickaxe"])
+	}
+
+	// Refunding the faster auto-clicker falls back to the basic one.
+	g = game.NewGame(eventstore.NewMemoryEventStore())
+	g.ThePlayer.Dust = 600
+	g.PurchaseUpgrade("auto_clicker_v0_1")
+	g.PurchaseUpgrade("auto_clicker_v1_0")
+	if err := g.RefundLastPurchase(); err != nil {
+		t.Fatalf("Failed to refund auto_clicker_v1_0: %v", err.Error())
+	}
+	if !g.AutoClickerActive || g.AutoClickerRate != 1 || g.ThePlayer.Dust != 500 {
+		t.Errorf("Expected the basic auto-clicker and 500 dust, got active %t, rate %d, dust %d", g.AutoClickerActive, g.AutoClickerRate, g.ThePlayer.Dust)
+	}
+
+	// The Heart of the Mountain cannot be refunded.
+	g.ThePlayer.Dust = 100000
+	g.PurchaseUpgrade("heart_of_the_mountain")
+	if err := g.RefundLastPurchase(); err == nil || err.Code != errors.ErrChoicePending {
+		t.Errorf("Expected the Heart of the Mountain not to be refundable, got %v", err)
+	}
+}
+
+// useTempSaveFile points game.SaveFile into a temporary directory for the rest of the test,
+// so that saving, e.g. after winning, never rewrites the save file of the repository.
+func useTempSaveFile(t *testing.T) string {
+	t.Helper()
+	old := game.SaveFile
+	game.SaveFile = filepath.Join(t.TempDir(), "save.json")
+	t.Cleanup(func() { game.SaveFile = old })
+	return game.SaveFile
+}
+
 func TestEndings(t *testing.T) {
-	g := game.NewGame()
+	useTempSaveFile(t)
+	g := game.NewGame(eventstore.NewMemoryEventStore())
 
 	// Mock os.Exit to prevent test termination
 	oldOsExit := game.OsExit
@@ -176,7 +265,7 @@ func TestEndings(t *testing.T) {
 	}
 
 	// Reset game state for LetRest test
-	g = game.NewGame()
+	g = game.NewGame(eventstore.NewMemoryEventStore())
 	g.ThePlayer.Dust = 100000 // Enough dust
 	g.PurchaseUpgrade("heart_of_the_mountain") // Re-purchase to set EndGameChoicePending
 
@@ -188,13 +277,100 @@ func TestEndings(t *testing.T) {
 	// Further assertions for saved state would require mocking os.WriteFile
 }
 
+func TestPhases(t *testing.T) {
+	useTempSaveFile(t)
+	store := eventstore.NewMemoryEventStore()
+	g := game.NewGame(store)
+	if g.Phase != game.PhasePlaying {
+		t.Fatalf("Expected a new game to be playing, got %s", g.Phase)
+	}
+	if err := g.TakeHeart(); err == nil || err.Code != errors.ErrNoChoicePending {
+		t.Errorf("Expected TakeHeart before the Heart purchase to be rejected, got %v", err)
+	}
+	if err := g.LetRest(); err == nil || err.Code != errors.ErrNoChoicePending {
+		t.Errorf("Expected LetRest before the Heart purchase to be rejected, got %v", err)
+	}
+
+	g.ThePlayer.Dust = 100000
+	if err := g.PurchaseUpgrade("heart_of_the_mountain"); err != nil {
+		t.Fatalf("Failed to purchase heart_of_the_mountain: %v", err.Error())
+	}
+	if g.Phase != game.PhaseChoicePending || !g.EndGameChoicePending {
+		t.Errorf("Expected the choice to be pending, got %s", g.Phase)
+	}
+	if err := g.Click(); err == nil || err.Code != errors.ErrChoicePending {
+		t.Errorf("Expected clicks to be rejected while the choice is pending, got %v", err)
+	}
+	if err := g.PurchaseUpgrade("stronger_pickaxe"); err == nil || err.Code != errors.ErrChoicePending {
+		t.Errorf("Expected purchases to be rejected while the choice is pending, got %v", err)
+	}
+
+	if err := g.LetRest(); err != nil {
+		t.Fatalf("LetRest failed: %v", err.Error())
+	}
+	if g.Phase != game.PhaseWon || !g.GameWon || g.EndGameChoicePending {
+		t.Errorf("Expected the game to be won, got %s", g.Phase)
+	}
+	for name, command := range map[string]func() *errors.GameError{"Click": g.Click, "TakeHeart": g.TakeHeart, "LetRest": g.LetRest} {
+		if err := command(); err == nil || err.Code != errors.ErrGameEnded {
+			t.Errorf("Expected %s after the ending to be rejected, got %v", name, err)
+		}
+	}
+
+	// Replay lands in the same phase, also when only part of the log is replayed.
+	replayed, err := game.LoadGameFromEvents(store)
+	if err != nil {
+		t.Fatalf("Failed to load game from events: %v", err.Error())
+	}
+	if replayed.Phase != game.PhaseWon {
+		t.Errorf("Expected the replayed game to be won, got %s", replayed.Phase)
+	}
+	tl, _ := game.NewTimeline(store)
+	tl.Seek(1)
+	if tl.Game().Phase != game.PhaseChoicePending {
+		t.Errorf("Expected the choice to be pending after the Heart purchase, got %s", tl.Game().Phase)
+	}
+
+	// The phase is saved by name.
+	path := filepath.Join(t.TempDir(), "save.json")
+	if err := g.SaveToFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); !bytes.Contains(data, []byte(`"Phase": "Won"`)) {
+		t.Errorf("Expected the phase to be saved by name, got %s", data)
+	}
+	loaded := game.NewGame(nil)
+	if err := loaded.LoadFromFile(path); err != nil || loaded.Phase != game.PhaseWon {
+		t.Errorf("Expected the loaded game to be won, got %s, %v", loaded.Phase, err)
+	}
+}
+
+func TestPhaseTransitions(t *testing.T) {
+	tests := []struct {
+		from, to game.Phase
+		allowed  bool
+	}{
+		{game.PhasePlaying, game.PhaseChoicePending, true},
+		{game.PhasePlaying, game.PhaseWon, false},
+		{game.PhaseChoicePending, game.PhaseWon, true},
+		{game.PhaseChoicePending, game.PhaseLost, true},
+		{game.PhaseChoicePending, game.PhasePlaying, false},
+		{game.PhaseWon, game.PhaseLost, false},
+		{game.PhaseLost, game.PhasePlaying, false},
+	}
+	for _, tt := range tests {
+		if got := tt.from.CanTransitionTo(tt.to); got != tt.allowed {
+			t.Errorf("%s -> %s: got %t, want %t", tt.from, tt.to, got, tt.allowed)
+		}
+	}
+}
+
 func TestSaveLoad(t *testing.T) {
 	// Use a temporary file for saving
-	tempSaveFile := "test_save.json"
-	defer os.Remove(tempSaveFile)
+	useTempSaveFile(t)
 
 	// Create an original game instance and modify its state
-	originalGame := game.NewGame()
+	originalGame := game.NewGame(eventstore.NewMemoryEventStore())
 	originalGame.TheRock.Health = 5000000
 	originalGame.ThePlayer.Dust = 12345
 	originalGame.ThePlayer.Damage = 5
@@ -216,7 +392,7 @@ func TestSaveLoad(t *testing.T) {
 	}
 
 	// Load a new game instance from the saved file
-	loadedGame := game.NewGame() // Start with a fresh game
+	loadedGame := game.NewGame(eventstore.NewMemoryEventStore()) // Start with a fresh game
 	if err := loadedGame.Load(); err != nil {
 		t.Fatalf("Failed to load game: %v", err)
 	}
@@ -257,8 +433,46 @@ func TestSaveLoad(t *testing.T) {
 	}
 }
 
+func TestSignedSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "save.json")
+	game.SaveKey = []byte("secret")
+	defer func() { game.SaveKey = nil }()
+
+	g := game.NewGame(eventstore.NewMemoryEventStore())
+	g.ThePlayer.Dust = 42
+	if err := g.SaveToFile(path); err != nil {
+		t.Fatalf("Failed to save game: %v", err)
+	}
+	if err := game.NewGame(eventstore.NewMemoryEventStore()).LoadFromFile(path); err != nil {
+		t.Fatalf("Failed to load signed save: %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if err := os.WriteFile(path, bytes.Replace(data, []byte(`"Dust": 42`), []byte(`"Dust": 4200`), 1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded := game.NewGame(eventstore.NewMemoryEventStore())
+	err := loaded.LoadFromFile(path)
+	if gameErr := errors.AsGameError(err); err == nil || gameErr.Code != errors.ErrTamperedSave {
+		t.Fatalf("Expected tampered save error, got %v", err)
+	}
+	if loaded.ThePlayer.Dust != 0 {
+		t.Errorf("Expected a tampered save not to be loaded, got %d dust", loaded.ThePlayer.Dust)
+	}
+
+	// Saving without a key removes the signature, which a signed game then requires.
+	game.SaveKey = nil
+	if err := g.SaveToFile(path); err != nil {
+		t.Fatal(err)
+	}
+	game.SaveKey = []byte("secret")
+	if err := loaded.LoadFromFile(path); err == nil {
+		t.Error("Expected an unsigned save to be refused")
+	}
+}
+
 func TestSetStateEarlyGame(t *testing.T) {
-	g := game.NewGame()
+	g := game.NewGame(eventstore.NewMemoryEventStore())
 	g.SetStateEarlyGame()
 
 	if g.TheRock.Health != game.InitialRockHealth {
@@ -288,7 +502,7 @@ func TestSetStateEarlyGame(t *testing.T) {
 }
 
 func TestSetStateMidGame(t *testing.T) {
-	g := game.NewGame()
+	g := game.NewGame(eventstore.NewMemoryEventStore())
 	g.SetStateMidGame()
 
 	if g.TheRock.Health != game.InitialRockHealth/2 {
@@ -315,7 +529,7 @@ func TestSetStateMidGame(t *testing.T) {
 }
 
 func TestSetStateEndGameReady(t *testing.T) {
-	g := game.NewGame()
+	g := game.NewGame(eventstore.NewMemoryEventStore())
 	g.SetStateEndGameReady()
 
 	if g.TheRock.Health != game.InitialRockHealth/10 {
@@ -343,3 +557,503 @@ func TestSetStateEndGameReady(t *testing.T) {
 		t.Errorf("EndGameReady: EndGameChoicePending should be false")
 	}
 }
+
+func TestGameReplayAfterEnding(t *testing.T) {
+	es := eventstore.NewMemoryEventStore()
+	originalGame := game.NewGame(es)
+
+	originalGame.ThePlayer.Dust = 100000
+	if err := originalGame.PurchaseUpgrade("heart_of_the_mountain"); err != nil {
+		t.Fatalf("Failed to purchase heart_of_the_mountain: %v", err.Error())
+	}
+	originalGame.TakeHeart()
+
+	// A log holding an ending event must still be loadable.
+	replayedGame, err := game.LoadGameFromEvents(es)
+	if err != nil {
+		t.Fatalf("Failed to load game from events: %v", err.Error())
+	}
+	if !replayedGame.GameOver {
+		t.Errorf("Replayed game should be over after HeartTaken")
+	}
+	if replayedGame.TheRock.Health != 0 {
+		t.Errorf("Replayed rock health mismatch: got %d, want %d", replayedGame.TheRock.Health, 0)
+	}
+}
+
+func TestSnapshotReplay(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "events.log")
+	es := eventstore.NewFileEventStore(logPath)
+	defer es.Close()
+	ss := game.NewSnapshotStore(logPath)
+
+	// An empty log yields a fresh game bound to the store.
+	originalGame, err := game.LoadGameFromEvents(es)
+	if err != nil {
+		t.Fatalf("Failed to load game from events: %v", err.Error())
+	}
+	originalGame.EnableSnapshots(ss, 5)
+	for i := 0; i < 12; i++ {
+		originalGame.Click()
+	}
+	originalGame.PurchaseUpgrade("stronger_pickaxe")
+	originalGame.Click()
+
+	snapshots, _ := ss.List()
+	if len(snapshots) != 2 {
+		t.Fatalf("Expected 2 snapshots, got %d", len(snapshots))
+	}
+
+	assertSameState := func(name string, loaded *game.Game) {
+		t.Helper()
+		if loaded.TheRock.Health != originalGame.TheRock.Health || loaded.ThePlayer.Dust != originalGame.ThePlayer.Dust || loaded.ThePlayer.Damage != originalGame.ThePlayer.Damage {
+			t.Errorf("%s: state mismatch: health=%d dust=%d damage=%d, want health=%d dust=%d damage=%d", name,
+				loaded.TheRock.Health, loaded.ThePlayer.Dust, loaded.ThePlayer.Damage,
+				originalGame.TheRock.Health, originalGame.ThePlayer.Dust, originalGame.ThePlayer.Damage)
+		}
+		if loaded.Dispatcher.LastSequence() != originalGame.Dispatcher.LastSequence() {
+			t.Errorf("%s: sequence mismatch: got %d, want %d", name, loaded.Dispatcher.LastSequence(), originalGame.Dispatcher.LastSequence())
+		}
+	}
+
+	loadedGame, err := game.LoadGameFromSnapshot(es, ss)
+	if err != nil {
+		t.Fatalf("Failed to load game from snapshot: %v", err.Error())
+	}
+	assertSameState("newest snapshot", loadedGame)
+
+	// A damaged snapshot is skipped in favour of an older one.
+	if err := os.WriteFile(snapshots[1], []byte(`{"sequence":10,"checksum":"bad","state":{}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loadedGame, err = game.LoadGameFromSnapshot(es, ss)
+	if err != nil {
+		t.Fatalf("Failed to load game from snapshot: %v", err.Error())
+	}
+	assertSameState("older snapshot", loadedGame)
+
+	written, rebuildErr := game.RebuildSnapshots(es, ss, 4)
+	if rebuildErr != nil {
+		t.Fatalf("Failed to rebuild snapshots: %v", rebuildErr)
+	}
+	if written != 3 {
+		t.Errorf("Rebuilt snapshot count mismatch: got %d, want %d", written, 3)
+	}
+	loadedGame, err = game.LoadGameFromSnapshot(es, ss)
+	if err != nil {
+		t.Fatalf("Failed to load game from snapshot: %v", err.Error())
+	}
+	assertSameState("rebuilt snapshot", loadedGame)
+}
+
+func TestSnapshotReplayDropsDuplicates(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "events.log")
+	es := eventstore.NewFileEventStore(logPath)
+	ss := game.NewSnapshotStore(logPath)
+	g := game.NewGame(es)
+	for i := 0; i < 3; i++ {
+		g.Click()
+	}
+	if err := ss.Save(g, g.Dispatcher.LastSequence()); err != nil {
+		t.Fatal(err)
+	}
+	g.ThePlayer.Dust = 1000
+	if err := g.PurchaseUpgrade("stronger_pickaxe"); err != nil {
+		t.Fatalf("Failed to purchase stronger_pickaxe: %v", err.Error())
+	}
+	for i := 0; i < 10; i++ {
+		g.Click()
+	}
+	if err := es.Close(); err != nil {
+		t.Fatalf("Failed to close event store: %v", err)
+	}
+
+	// Repeat the last click after the snapshot, as a log merged with a copy of itself would.
+	segment := filepath.Join(filepath.Dir(logPath), "events-000001.log")
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n")
+	data = append(data, lines[len(lines)-1]+"\n"...)
+	if err := os.WriteFile(segment, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Counted twice, the click would close the refund window.
+	loaded, gerr := game.LoadGameFromSnapshot(eventstore.NewFileEventStore(logPath), ss)
+	if gerr != nil {
+		t.Fatalf("Failed to load game from snapshot: %v", gerr.Error())
+	}
+	loaded.SetRefundWindow(game.RefundWindow{Clicks: 11})
+	if err := loaded.RefundLastPurchase(); err != nil {
+		t.Errorf("Expected the duplicated click to count once, got %v", err)
+	}
+}
+
+func TestCompactedReplay(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "events.log")
+	es := eventstore.NewFileEventStore(logPath)
+	defer es.Close()
+
+	originalGame, err := game.LoadGameFromEvents(es)
+	if err != nil {
+		t.Fatalf("Failed to load game from events: %v", err.Error())
+	}
+	for i := 0; i < 35; i++ {
+		originalGame.Click()
+	}
+	originalGame.PurchaseUpgrade("stronger_pickaxe") // Costs 10
+	originalGame.PurchaseUpgrade("stronger_pickaxe") // Costs 20
+	for i := 0; i < 10; i++ {
+		originalGame.Click()
+	}
+
+	stats, compactErr := es.Compact(false)
+	if compactErr != nil {
+		t.Fatalf("Failed to compact event log: %v", compactErr.Error())
+	}
+	if stats.RecordsOut >= stats.RecordsIn {
+		t.Errorf("Expected the log to shrink, got %d -> %d records", stats.RecordsIn, stats.RecordsOut)
+	}
+
+	replayedGame, err := game.LoadGameFromEvents(es)
+	if err != nil {
+		t.Fatalf("Failed to load game from compacted events: %v", err.Error())
+	}
+	if replayedGame.TheRock.Health != originalGame.TheRock.Health || replayedGame.ThePlayer.Dust != originalGame.ThePlayer.Dust || replayedGame.ThePlayer.Damage != originalGame.ThePlayer.Damage {
+		t.Errorf("Compacted replay mismatch: health=%d dust=%d damage=%d, want health=%d dust=%d damage=%d",
+			replayedGame.TheRock.Health, replayedGame.ThePlayer.Dust, replayedGame.ThePlayer.Damage,
+			originalGame.TheRock.Health, originalGame.ThePlayer.Dust, originalGame.ThePlayer.Damage)
+	}
+	if replayedGame.Upgrades.PlayerUpgrades["stronger_pickaxe"] != 2 {
+		t.Errorf("Compacted replay upgrade level mismatch: got %d, want %d", replayedGame.Upgrades.PlayerUpgrades["stronger_pickaxe"], 2)
+	}
+	if replayedGame.Dispatcher.LastSequence() != originalGame.Dispatcher.LastSequence() {
+		t.Errorf("Compacted replay sequence mismatch: got %d, want %d", replayedGame.Dispatcher.LastSequence(), originalGame.Dispatcher.LastSequence())
+	}
+}
+
+func TestBinaryReplay(t *testing.T) {
+	dir := t.TempDir()
+	opts := eventstore.DefaultFileStoreOptions
+	opts.Format = eventstore.FormatBinary
+	es := eventstore.NewFileEventStoreWithOptions(filepath.Join(dir, "events.bin"), opts)
+
+	originalGame, err := game.LoadGameFromEvents(es)
+	if err != nil {
+		t.Fatalf("Failed to load game from events: %v", err.Error())
+	}
+	for i := 0; i < 35; i++ {
+		originalGame.Click()
+	}
+	originalGame.PurchaseUpgrade("stronger_pickaxe")
+	originalGame.TakeHeart()
+	if err := es.Close(); err != nil {
+		t.Fatalf("Failed to close event store: %v", err)
+	}
+
+	// Replaying the binary log and its JSON conversion must both rebuild the same game.
+	jsonStore := eventstore.NewFileEventStore(filepath.Join(dir, "events.log"))
+	defer jsonStore.Close()
+	if _, err := eventstore.Convert(es, jsonStore); err != nil {
+		t.Fatalf("Failed to convert event log: %v", err.Error())
+	}
+	for name, store := range map[string]events.EventStore{"binary": es, "json": jsonStore} {
+		replayedGame, err := game.LoadGameFromEvents(store)
+		if err != nil {
+			t.Fatalf("Failed to load game from %s events: %v", name, err.Error())
+		}
+		if replayedGame.TheRock.Health != originalGame.TheRock.Health || replayedGame.ThePlayer.Dust != originalGame.ThePlayer.Dust ||
+			replayedGame.ThePlayer.Damage != originalGame.ThePlayer.Damage || replayedGame.GameOver != originalGame.GameOver {
+			t.Errorf("%s replay mismatch: health=%d dust=%d damage=%d, want health=%d dust=%d damage=%d", name,
+				replayedGame.TheRock.Health, replayedGame.ThePlayer.Dust, replayedGame.ThePlayer.Damage,
+				originalGame.TheRock.Health, originalGame.ThePlayer.Dust, originalGame.ThePlayer.Damage)
+		}
+		if replayedGame.Dispatcher.LastSequence() != originalGame.Dispatcher.LastSequence() {
+			t.Errorf("%s replay sequence mismatch: got %d, want %d", name, replayedGame.Dispatcher.LastSequence(), originalGame.Dispatcher.LastSequence())
+		}
+	}
+}
+
+func TestFailedDispatchLeavesStateUnchanged(t *testing.T) {
+	store := eventstore.NewMemoryEventStore()
+	g := game.NewGame(store)
+	g.ThePlayer.Dust = 10
+	store.Close() // Appending now fails
+
+	err := g.Click()
+	if err == nil || err.Code != errors.ErrDispatchFailed || !stderrors.Is(err, events.ErrClosed) {
+		t.Fatalf("Expected a dispatch error caused by the closed store, got %v", err)
+	}
+	if g.TheRock.Health != game.InitialRockHealth || g.ThePlayer.Dust != 10 || g.CurrentRockMessage != "" {
+		t.Errorf("Unrecorded click changed the game: health %d, dust %d, message %q", g.TheRock.Health, g.ThePlayer.Dust, g.CurrentRockMessage)
+	}
+
+	err = g.PurchaseUpgrade("stronger_pickaxe")
+	if err == nil || err.Code != errors.ErrDispatchFailed {
+		t.Fatalf("Expected a dispatch error for the purchase, got %v", err)
+	}
+	if g.ThePlayer.Dust != 10 || g.ThePlayer.Damage != 1 || g.Upgrades.PlayerUpgrades["stronger_pickaxe"] != 0 {
+		t.Errorf("Unrecorded purchase changed the game: dust %d, damage %d, level %d", g.ThePlayer.Dust, g.ThePlayer.Damage, g.Upgrades.PlayerUpgrades["stronger_pickaxe"])
+	}
+	if g.Dispatcher.LastSequence() != 0 {
+		t.Errorf("Unrecorded events used up sequence numbers, last sequence is %d", g.Dispatcher.LastSequence())
+	}
+}
+
+func TestSessionsContinueSequence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	for session := 0; session < 2; session++ {
+		es := eventstore.NewFileEventStore(path)
+		g := game.NewGame(es)
+		for i := 0; i < 3; i++ {
+			if err := g.Click(); err != nil {
+				t.Fatalf("Session %d failed to click: %v", session, err.Error())
+			}
+		}
+		if err := es.Close(); err != nil {
+			t.Fatalf("Failed to close event store: %v", err)
+		}
+	}
+
+	// The second session numbers its events after those of the first.
+	es := eventstore.NewFileEventStore(path)
+	records, err := eventstore.LoadRecords(es)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, record := range records {
+		if record.Sequence != uint64(i+1) {
+			t.Errorf("Record %d has sequence %d, want %d", i, record.Sequence, i+1)
+		}
+	}
+	if len(records) != 6 {
+		t.Fatalf("Expected 6 records, got %d", len(records))
+	}
+	var tail []uint64
+	es.ReadFrom(3, func(record *events.Record) error {
+		tail = append(tail, record.Sequence)
+		return nil
+	})
+	if len(tail) != 4 || tail[0] != 3 || tail[3] != 6 {
+		t.Errorf("Expected sequences 3 to 6 from sequence 3, got %v", tail)
+	}
+}
+
+func TestSessionsVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	for session := 0; session < 2; session++ {
+		// Like the game at startup, every session plays on from the state the log ends in.
+		es := eventstore.NewFileEventStore(path)
+		g, gerr := game.LoadGameFromEvents(es)
+		if gerr != nil {
+			t.Fatalf("Session %d failed to load: %v", session, gerr.Error())
+		}
+		for i := 0; i < 3; i++ {
+			if err := g.Click(); err != nil {
+				t.Fatalf("Session %d failed to click: %v", session, err.Error())
+			}
+		}
+		if g.ThePlayer.Dust != 3*(session+1) {
+			t.Errorf("Session %d dust mismatch: got %d, want %d", session, g.ThePlayer.Dust, 3*(session+1))
+		}
+		if err := es.Close(); err != nil {
+			t.Fatalf("Failed to close event store: %v", err)
+		}
+	}
+
+	checked, gerr := game.Verify(eventstore.NewFileEventStore(path))
+	if gerr != nil {
+		t.Fatalf("Expected both sessions to verify, got %v", gerr.Error())
+	}
+	if checked != 6 {
+		t.Errorf("Expected 6 records checked, got %d", checked)
+	}
+}
+
+func TestReplayEventsDropsDuplicates(t *testing.T) {
+	store := eventstore.NewMemoryEventStore()
+	g := game.NewGame(store)
+	for i := 0; i < 3; i++ {
+		if err := g.Click(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, err := eventstore.LoadRecords(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Events the game dispatched itself are already applied.
+	dropped, err := g.ReplayEvents(records)
+	if err != nil || dropped != 3 || g.ThePlayer.Dust != 3 {
+		t.Errorf("Expected 3 duplicates dropped and 3 dust, got %d dropped, %d dust, err %v", dropped, g.ThePlayer.Dust, err)
+	}
+
+	// A fresh game applies each event once, even when the log was merged with itself.
+	replayed := game.NewGame(nil)
+	dropped, err = replayed.ReplayEvents(append(records, records...))
+	if err != nil || dropped != 3 || replayed.ThePlayer.Dust != 3 {
+		t.Errorf("Expected 3 duplicates dropped and 3 dust, got %d dropped, %d dust, err %v", dropped, replayed.ThePlayer.Dust, err)
+	}
+
+	// A duplicate further back than the window is applied again, unless the window is unbounded.
+	merged := append(append([]*events.Record{}, records...), records[0])
+	for window, want := range map[int]int{2: 0, 0: 1} {
+		replayed := game.NewGame(nil)
+		replayed.SetDedupWindow(window)
+		if dropped, err := replayed.ReplayEvents(merged); err != nil || dropped != want {
+			t.Errorf("Window %d: expected %d duplicates dropped, got %d, err %v", window, want, dropped, err)
+		}
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	store := eventstore.NewMemoryEventStore()
+	g := game.NewGame(store)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	g.Dispatcher.SetClock(func() time.Time { return now })
+	for i := 0; i < 10; i++ {
+		g.Click()
+		now = now.Add(time.Second)
+	}
+	g.PurchaseUpgrade("stronger_pickaxe") // Sequence 11
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Second)
+		g.Click()
+	}
+
+	tl, err := game.NewTimeline(store)
+	if err != nil {
+		t.Fatalf("NewTimeline failed: %v", err)
+	}
+	tl.SetCheckpointEvery(4)
+	if tl.Len() != 16 {
+		t.Fatalf("Expected 16 records, got %d", tl.Len())
+	}
+
+	if err := tl.Seek(11); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	if s := tl.State(); s.Sequence != 11 || s.Damage != 2 || s.Dust != 0 || s.Upgrades["stronger_pickaxe"] != 1 {
+		t.Errorf("State after the purchase mismatch: %+v", s)
+	}
+	if ok, err := tl.Back(); !ok || err != nil {
+		t.Fatalf("Back failed: %v, %v", ok, err)
+	}
+	if s := tl.State(); s.Sequence != 10 || s.Damage != 1 || s.Dust != 10 || s.Upgrades["stronger_pickaxe"] != 0 {
+		t.Errorf("State before the purchase mismatch: %+v", s)
+	}
+	if ok, err := tl.Step(); !ok || err != nil {
+		t.Fatalf("Step failed: %v, %v", ok, err)
+	}
+	if s := tl.State(); s.Sequence != 11 || s.Damage != 2 {
+		t.Errorf("State after stepping forward mismatch: %+v", s)
+	}
+
+	// Seeking by time lands on the last event dispatched by then.
+	if err := tl.SeekTime(time.Date(2024, 5, 1, 12, 0, 4, 500, time.UTC)); err != nil {
+		t.Fatalf("SeekTime failed: %v", err)
+	}
+	if s := tl.State(); s.Sequence != 5 || s.Dust != 5 || s.RockHealth != game.InitialRockHealth-5 {
+		t.Errorf("State at time mismatch: %+v", s)
+	}
+
+	d, err := tl.Diff(5, 16)
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	// Five more clicks for 10 dust, spent on the pickaxe, then five clicks at damage 2
+	if d.Dust != 0 || d.Damage != 1 || d.RockHealth != -(5+5*2) || d.Upgrades["stronger_pickaxe"] != 1 {
+		t.Errorf("Diff mismatch:\n%s", d)
+	}
+	if ok, _ := tl.Step(); ok {
+		t.Errorf("Expected Step at the end of the timeline to report false")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	store := eventstore.NewMemoryEventStore()
+	g := game.NewGame(store)
+	for i := 0; i < 12; i++ {
+		g.Click()
+	}
+	g.PurchaseUpgrade("stronger_pickaxe")
+	for i := 0; i < 3; i++ {
+		g.Click()
+	}
+	g.RefundLastPurchase()
+
+	checked, err := game.Verify(store)
+	if err != nil || checked != 17 {
+		t.Fatalf("Expected a valid log of 17 records, got %d records and %v", checked, err)
+	}
+
+	tests := []struct {
+		name      string
+		tamper    func(records []*events.Record)
+		sequence  uint64
+		invariant string
+	}{
+		{"RockHealth", func(records []*events.Record) {
+			records[4].Event.(*events.ClickEvent).RockHealthBefore += 100
+		}, 5, "RockHealthBefore matches the rock's health"},
+		{"Damage", func(records []*events.Record) {
+			click := records[14].Event.(*events.ClickEvent)
+			click.DamageDealt, click.RockHealthAfter = 50, click.RockHealthBefore-50
+		}, 15, "DamageDealt matches the player's damage"},
+		{"Cost", func(records []*events.Record) {
+			records[12].Event.(*events.UpgradePurchasedEvent).NewDust += 5
+		}, 13, "NewDust is the player's dust minus the upgrade cost"},
+		{"Refund", func(records []*events.Record) {
+			records[16].Event.(*events.PurchaseRefundedEvent).NewDust += 5
+		}, 17, "NewDust is the player's dust plus the upgrade cost"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := eventstore.NewMemoryEventStore()
+			copies, _ := eventstore.LoadRecords(store) // Fresh copies of the records
+			tt.tamper(copies)
+			for _, record := range copies {
+				tampered.Append(record)
+			}
+
+			checked, err := game.Verify(tampered)
+			var v *game.Violation
+			if err == nil || err.Code != errors.ErrInvariantViolated || !stderrors.As(err, &v) {
+				t.Fatalf("Expected an invariant violation, got %v", err)
+			}
+			if v.Sequence != tt.sequence || v.Invariant != tt.invariant || checked != int(tt.sequence-1) {
+				t.Errorf("Expected %q at sequence %d, got %v after %d records", tt.invariant, tt.sequence, v, checked)
+			}
+		})
+	}
+}
+
+func TestVerifyReportsCorruptRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	es := eventstore.NewFileEventStore(path)
+	g := game.NewGame(es)
+	for i := 0; i < 3; i++ {
+		g.Click()
+	}
+	es.Close()
+
+	// Hand-edit the last record so that it no longer matches its checksum.
+	segment := filepath.Join(filepath.Dir(path), "events-000001.log")
+	data, _ := os.ReadFile(segment)
+	i := bytes.LastIndex(data, []byte(`"PlayerDustAfter":3`))
+	data[i+len(`"PlayerDustAfter":`)] = '9'
+	if err := os.WriteFile(segment, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	checked, err := game.Verify(eventstore.NewFileEventStore(path))
+	if err == nil || err.Code != errors.ErrCorruptEventLog || checked != 2 {
+		t.Fatalf("Expected a corrupt log error after 2 records, got %d records and %v", checked, err)
+	}
+	if after, _ := os.ReadFile(segment); !bytes.Equal(after, data) {
+		t.Errorf("Verify changed the log it was checking")
+	}
+}
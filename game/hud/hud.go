@@ -93,7 +93,7 @@ func (h *HUD) Draw(screen *ebiten.Image, g *game.Game, shadersEnabled bool) {
 	}
 
 	// Draw end-game choice buttons if pending
-	if g.EndGameChoicePending {
+	if g.Phase == game.PhaseChoicePending {
 		// Draw "Take the Heart" button
 		ebitenutil.DrawRect(screen, float64(h.TakeHeartButton.Min.X), float64(h.TakeHeartButton.Min.Y), float64(h.TakeHeartButton.Dx()), float64(h.TakeHeartButton.Dy()), color.RGBA{R: 200, G: 50, B: 50, A: 255})
 		ebitenutil.DebugPrintAt(screen, "Take the Heart", h.TakeHeartButton.Min.X+10, h.TakeHeartButton.Min.Y+15)
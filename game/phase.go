@@ -0,0 +1,119 @@
+package game
+
+import (
+	"fmt"
+
+	"clicker2/game/errors"
+)
+
+// Phase is the stage the game is in, which decides the commands the player can give.
+type Phase int
+
+const (
+	// PhasePlaying is the main game: clicking the rock and buying upgrades.
+	PhasePlaying Phase = iota
+	// PhaseChoicePending follows the purchase of the Heart of the Mountain, until the player
+	// takes the Heart or lets the mountain rest.
+	PhaseChoicePending
+	// PhaseWon is the good ending, after letting the mountain rest.
+	PhaseWon
+	// PhaseLost is the bad ending, after taking the Heart.
+	PhaseLost
+)
+
+// phaseNames maps each phase to its name, as written to save files.
+var phaseNames = map[Phase]string{
+	PhasePlaying:       "Playing",
+	PhaseChoicePending: "ChoicePending",
+	PhaseWon:           "Won",
+	PhaseLost:          "Lost",
+}
+
+// transitions lists the phases each phase can move on to. Both endings are final.
+var transitions = map[Phase][]Phase{
+	PhasePlaying:       {PhaseChoicePending},
+	PhaseChoicePending: {PhaseWon, PhaseLost},
+}
+
+// String returns the name of the phase.
+func (p Phase) String() string {
+	if name, ok := phaseNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("Phase(%d)", int(p))
+}
+
+// MarshalText writes the phase by name.
+func (p Phase) MarshalText() ([]byte, error) {
+	if _, ok := phaseNames[p]; !ok {
+		return nil, fmt.Errorf("unknown phase %d", int(p))
+	}
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText reads a phase written by MarshalText.
+func (p *Phase) UnmarshalText(text []byte) error {
+	for phase, name := range phaseNames {
+		if name == string(text) {
+			*p = phase
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown phase %q", text)
+}
+
+// CanTransitionTo reports whether the game can move from phase p to phase to.
+func (p Phase) CanTransitionTo(to Phase) bool {
+	for _, next := range transitions[p] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// setPhase moves the game to a phase and updates the flags that mirror it. Event handlers
+// call it for every ending or Heart purchase they apply, so replay lands in the same phase
+// even for logs written before commands were checked against the phase.
+func (g *Game) setPhase(p Phase) {
+	g.Phase = p
+	g.EndGameChoicePending = p == PhaseChoicePending
+	g.GameWon = p == PhaseWon
+	g.GameOver = p == PhaseLost
+}
+
+// syncPhase derives the phase from the flags of a save file or snapshot written before phases existed.
+func (g *Game) syncPhase() {
+	switch {
+	case g.Phase != PhasePlaying:
+		g.setPhase(g.Phase)
+	case g.GameOver:
+		g.setPhase(PhaseLost)
+	case g.GameWon:
+		g.setPhase(PhaseWon)
+	case g.EndGameChoicePending:
+		g.setPhase(PhaseChoicePending)
+	}
+}
+
+// requirePlaying returns the error for a command of the main game given in another phase, or nil.
+func (g *Game) requirePlaying() *errors.GameError {
+	switch g.Phase {
+	case PhasePlaying:
+		return nil
+	case PhaseChoicePending:
+		return errors.NewGameError(errors.ErrChoicePending)
+	}
+	return errors.NewGameError(errors.ErrGameEnded)
+}
+
+// requireTransition returns the error for an end-game choice that cannot move the game to phase to, or nil.
+func (g *Game) requireTransition(to Phase) *errors.GameError {
+	switch {
+	case g.Phase.CanTransitionTo(to):
+		return nil
+	case g.Phase == PhasePlaying:
+		return errors.NewGameError(errors.ErrNoChoicePending)
+	}
+	return errors.NewGameError(errors.ErrGameEnded)
+}
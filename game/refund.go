@@ -0,0 +1,115 @@
+package game
+
+import (
+	"log"
+	"time"
+
+	"clicker2/game/errors"
+	"clicker2/game/events"
+)
+
+// RefundWindow limits how long after a purchase it can still be refunded.
+// A purchase is refundable until Duration has passed or Clicks clicks were made since,
+// whichever comes first. A zero field does not limit by that measure.
+type RefundWindow struct {
+	Duration time.Duration
+	Clicks   int
+}
+
+// DefaultRefundWindow gives the player ten seconds and ten clicks to undo a misclicked purchase.
+var DefaultRefundWindow = RefundWindow{Duration: 10 * time.Second, Clicks: 10}
+
+// refundablePurchase is the last purchase, while it may still be refunded.
+type refundablePurchase struct {
+	sequence  uint64
+	upgradeID string
+	level     int // Level the purchase raised the upgrade to
+	cost      int
+	at        time.Time
+	clicks    int // Clicks made since the purchase
+}
+
+// SetRefundWindow sets how long purchases can be refunded, DefaultRefundWindow by default.
+func (g *Game) SetRefundWindow(w RefundWindow) {
+	g.refundWindow = w
+}
+
+// RefundLastPurchase undoes the last upgrade purchase, giving back the dust it cost and
+// returning the upgrade to its previous level. Only the last purchase can be refunded, only
+// within the refund window and never the Heart of the Mountain. A game loaded from a snapshot
+// cannot refund purchases made before the snapshot.
+func (g *Game) RefundLastPurchase() *errors.GameError {
+	if err := g.requirePlaying(); err != nil {
+		return err
+	}
+	p := g.lastPurchase
+	if p == nil {
+		return errors.NewGameError(errors.ErrNotRefundable)
+	}
+	w := g.refundWindow
+	if (w.Duration > 0 && g.Dispatcher.Now().Sub(p.at) > w.Duration) || (w.Clicks > 0 && p.clicks >= w.Clicks) {
+		return errors.NewGameError(errors.ErrRefundWindowClosed)
+	}
+
+	// Like purchases, the refund only changes the game once it is recorded.
+	return g.dispatch(&events.PurchaseRefundedEvent{
+		PlayerID:         "player1", // Placeholder
+		UpgradeID:        p.upgradeID,
+		PurchaseSequence: p.sequence,
+		NewLevel:         p.level - 1,
+		OldDust:          g.ThePlayer.Dust,
+		NewDust:          g.ThePlayer.Dust + p.cost,
+	})
+}
+
+// ApplyPurchaseRefunded applies the state changes from a PurchaseRefundedEvent.
+func (g *Game) ApplyPurchaseRefunded(event events.Event) {
+	if e, ok := event.(*events.PurchaseRefundedEvent); ok {
+		g.Upgrades.PlayerUpgrades[e.UpgradeID] = e.NewLevel
+		g.ThePlayer.Dust = e.NewDust
+		upgrade, err := g.Upgrades.GetUpgrade(e.UpgradeID)
+		if err != nil {
+			log.Printf("Error getting upgrade %s during refund: %v", e.UpgradeID, err.Error())
+			return
+		}
+		upgrade.ReconstructEffect(g, e.NewLevel)
+	}
+}
+
+// trackRefundWindow keeps track of the last purchase and of the clicks made since,
+// both when events are dispatched and when they are replayed.
+func (g *Game) trackRefundWindow(record *events.Record) error {
+	switch e := record.Event.(type) {
+	case *events.UpgradePurchasedEvent:
+		g.lastPurchase = nil
+		if e.UpgradeID == "heart_of_the_mountain" {
+			return nil // Ends the game, so it cannot be undone
+		}
+		upgrade, err := g.Upgrades.GetUpgrade(e.UpgradeID)
+		if err != nil {
+			return nil
+		}
+		cost := upgrade.Cost(e.NewLevel - 1)
+		if e.OldDust != 0 { // Not recorded by older versions
+			cost = e.OldDust - e.NewDust
+		}
+		g.lastPurchase = &refundablePurchase{
+			sequence:  record.Sequence,
+			upgradeID: e.UpgradeID,
+			level:     e.NewLevel,
+			cost:      cost,
+			at:        record.Timestamp,
+		}
+	case *events.ClickEvent:
+		if g.lastPurchase != nil {
+			g.lastPurchase.clicks++
+		}
+	case *events.ClicksAggregatedEvent:
+		if g.lastPurchase != nil {
+			g.lastPurchase.clicks += e.Clicks
+		}
+	case *events.PurchaseRefundedEvent, *events.HeartTakenEvent, *events.MountainRestedEvent:
+		g.lastPurchase = nil
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+// Package rules derives events from patterns in the stream of dispatched events,
+// such as ten clicks within a second.
+//
+// A Rule counts the events it matches over a sliding window and emits a derived event
+// once enough of them fall within it. Derived events are dispatched like any other event,
+// so they are stored in the event log and replayed from it; they are never derived again
+// during replay, and rules never count them, so a rule cannot trigger itself.
+//
+//	engine, err := rules.New(game.Dispatcher, rules.DefaultRules...)
+package rules
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"clicker2/game/events"
+)
+
+// Rule declares a pattern of events and the event derived from it.
+// It fires when Count events selected by Match were dispatched within Window,
+// measured by their timestamps. With a MaxGap, the count starts over whenever
+// two matching events are further apart than that. After firing, the count starts over.
+type Rule struct {
+	Name   string        // Identifies the rule in logs
+	Match  events.Filter // Events counted by the rule, all events if nil
+	Count  int
+	Window time.Duration
+	MaxGap time.Duration // Zero allows any gap within the window
+	Emit   func(m Match) events.Event
+}
+
+// Match is the run of events that made a rule fire, oldest first.
+type Match struct {
+	Rule    string
+	Records []*events.Record
+}
+
+// First returns the oldest record of the match.
+func (m Match) First() *events.Record {
+	return m.Records[0]
+}
+
+// Last returns the record that made the rule fire.
+func (m Match) Last() *events.Record {
+	return m.Records[len(m.Records)-1]
+}
+
+// Duration returns the time between the first and the last record.
+func (m Match) Duration() time.Duration {
+	return m.Last().Timestamp.Sub(m.First().Timestamp)
+}
+
+// playerID returns the player of the first click in the match, if any.
+func (m Match) playerID() string {
+	for _, record := range m.Records {
+		if click, ok := record.Event.(*events.ClickEvent); ok {
+			return click.PlayerID
+		}
+	}
+	return ""
+}
+
+// ClickBurst fires for ten clicks within one second.
+var ClickBurst = Rule{
+	Name:   "ClickBurst",
+	Match:  events.OfType("Click"),
+	Count:  10,
+	Window: time.Second,
+	Emit: func(m Match) events.Event {
+		return &events.ClickBurstEvent{
+			PlayerID:      m.playerID(),
+			Clicks:        len(m.Records),
+			FirstSequence: m.First().Sequence,
+			LastSequence:  m.Last().Sequence,
+			Duration:      m.Duration(),
+		}
+	},
+}
+
+// SustainedMining fires for sixty clicks within thirty seconds without a pause longer than two seconds.
+var SustainedMining = Rule{
+	Name:   "SustainedMining",
+	Match:  events.OfType("Click"),
+	Count:  60,
+	Window: 30 * time.Second,
+	MaxGap: 2 * time.Second,
+	Emit: func(m Match) events.Event {
+		return &events.SustainedMiningEvent{
+			PlayerID:      m.playerID(),
+			Clicks:        len(m.Records),
+			FirstSequence: m.First().Sequence,
+			LastSequence:  m.Last().Sequence,
+			Duration:      m.Duration(),
+		}
+	},
+}
+
+// DefaultRules are the rules of the game.
+var DefaultRules = []Rule{ClickBurst, SustainedMining}
+
+// ruleState is a rule with the matching events within its window.
+type ruleState struct {
+	Rule
+	window []*events.Record
+}
+
+// observe adds a record to the window and returns the match if the rule fires.
+func (rs *ruleState) observe(record *events.Record) (Match, bool) {
+	if !rs.Match(record) {
+		return Match{}, false
+	}
+	if n := len(rs.window); n > 0 && rs.MaxGap > 0 && record.Timestamp.Sub(rs.window[n-1].Timestamp) > rs.MaxGap {
+		rs.window = nil
+	}
+	rs.window = append(rs.window, record)
+	for record.Timestamp.Sub(rs.window[0].Timestamp) > rs.Window {
+		rs.window = rs.window[1:]
+	}
+	if len(rs.window) < rs.Count {
+		return Match{}, false
+	}
+	m := Match{Rule: rs.Name, Records: rs.window}
+	rs.window = nil
+	return m, true
+}
+
+// Engine evaluates rules against the events dispatched by a dispatcher.
+type Engine struct {
+	dispatcher *events.EventDispatcher
+	mu         sync.Mutex // Protects rules and derived
+	rules      []*ruleState
+	derived    map[events.Event]struct{} // Derived events being dispatched, which the rules skip
+}
+
+// New creates an Engine for rules and adds it to the middleware of ed. Derived events are
+// dispatched through ed once the event they were derived from has been stored and applied,
+// and are not seen by the rules. Emit must return a new pointer for every match, like any event.
+func New(ed *events.EventDispatcher, rules ...Rule) (*Engine, error) {
+	e := &Engine{dispatcher: ed, derived: make(map[events.Event]struct{})}
+	for _, rule := range rules {
+		if rule.Count <= 0 || rule.Window <= 0 || rule.Emit == nil {
+			return nil, fmt.Errorf("rule %q needs a positive count and window and an Emit function", rule.Name)
+		}
+		if rule.Match == nil {
+			rule.Match = events.AllEvents()
+		}
+		e.rules = append(e.rules, &ruleState{Rule: rule})
+	}
+	ed.Use(e.middleware)
+	return e, nil
+}
+
+// middleware observes every dispatched event that was stored and applied, except derived ones.
+func (e *Engine) middleware(next events.DispatchFunc) events.DispatchFunc {
+	return func(record *events.Record) error {
+		if err := next(record); err != nil {
+			return err
+		}
+		for _, derived := range e.observe(record) {
+			err := e.dispatcher.Dispatch(derived)
+			e.mu.Lock()
+			delete(e.derived, derived) // Also when it failed before reaching observe
+			e.mu.Unlock()
+			if err != nil {
+				// The triggering event was recorded, so its dispatch still succeeded.
+				log.Printf("Error dispatching derived %s event: %v", derived.EventType(), err)
+			}
+		}
+		return nil
+	}
+}
+
+// observe passes a record to every rule and returns the events derived from it,
+// which are remembered until they have been dispatched so they are not observed in turn.
+func (e *Engine) observe(record *events.Record) []events.Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.derived[record.Event]; ok {
+		return nil
+	}
+	var derived []events.Event
+	for _, rs := range e.rules {
+		if m, ok := rs.observe(record); ok {
+			event := rs.Emit(m)
+			e.derived[event] = struct{}{}
+			derived = append(derived, event)
+		}
+	}
+	return derived
+}
@@ -0,0 +1,148 @@
+package rules_test
+
+import (
+	"testing"
+	"time"
+
+	"clicker2/game/events"
+	"clicker2/game/eventstore"
+	"clicker2/game/rules"
+)
+
+// fakeClock returns a clock for a dispatcher and a function that moves it forward.
+func fakeClock() (func() time.Time, func(time.Duration)) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	return func() time.Time { return now }, func(d time.Duration) { now = now.Add(d) }
+}
+
+func eventTypes(t *testing.T, store events.EventStore) []string {
+	t.Helper()
+	records, err := eventstore.LoadRecords(store)
+	if err != nil {
+		t.Fatalf("Failed to load records: %v", err)
+	}
+	var types []string
+	for _, record := range records {
+		types = append(types, record.Event.EventType())
+	}
+	return types
+}
+
+func TestClickBurst(t *testing.T) {
+	store := eventstore.NewMemoryEventStore()
+	ed := events.NewEventDispatcher(store)
+	now, advance := fakeClock()
+	ed.SetClock(now)
+	if _, err := rules.New(ed, rules.ClickBurst); err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	var bursts []*events.ClickBurstEvent
+	ed.Register("ClickBurst", func(event events.Event) {
+		bursts = append(bursts, event.(*events.ClickBurstEvent))
+	})
+
+	// Ten clicks spread over more than a second are not a burst...
+	for i := 0; i < 10; i++ {
+		ed.Dispatch(&events.ClickEvent{PlayerID: "player1"})
+		advance(150 * time.Millisecond)
+	}
+	if len(bursts) != 0 {
+		t.Fatalf("Expected no burst for slow clicks, got %+v", bursts[0])
+	}
+	// ...but ten within one are.
+	advance(time.Second)
+	for i := 0; i < 10; i++ {
+		advance(50 * time.Millisecond)
+		ed.Dispatch(&events.ClickEvent{PlayerID: "player1"})
+	}
+	if len(bursts) != 1 {
+		t.Fatalf("Expected one burst, got %d", len(bursts))
+	}
+	burst := bursts[0]
+	if burst.Clicks != 10 || burst.LastSequence != 20 || burst.LastSequence-burst.FirstSequence != 9 || burst.PlayerID != "player1" {
+		t.Errorf("Unexpected burst: %+v", burst)
+	}
+
+	types := eventTypes(t, store)
+	if len(types) != 21 || types[20] != "ClickBurst" {
+		t.Errorf("Expected the burst to be stored after the click that completed it, got %v", types)
+	}
+}
+
+func TestSustainedMiningResetsAfterPause(t *testing.T) {
+	ed := events.NewEventDispatcher(nil)
+	now, advance := fakeClock()
+	ed.SetClock(now)
+	rules.New(ed, rules.SustainedMining)
+	sustained := 0
+	ed.Register("SustainedMining", func(event events.Event) { sustained++ })
+
+	for i := 0; i < 59; i++ {
+		ed.Dispatch(&events.ClickEvent{})
+		advance(400 * time.Millisecond)
+	}
+	advance(3 * time.Second) // Pause longer than the rule allows
+	for i := 0; i < 59; i++ {
+		ed.Dispatch(&events.ClickEvent{})
+		advance(400 * time.Millisecond)
+	}
+	if sustained != 0 {
+		t.Fatalf("Expected the pause to start the count over, got %d events", sustained)
+	}
+	ed.Dispatch(&events.ClickEvent{})
+	if sustained != 1 {
+		t.Errorf("Expected one SustainedMining event, got %d", sustained)
+	}
+}
+
+func TestDerivedEventsAreNotDerivedAgainOnReplay(t *testing.T) {
+	store := eventstore.NewMemoryEventStore()
+	ed := events.NewEventDispatcher(store)
+	rules.New(ed, rules.ClickBurst)
+	for i := 0; i < 10; i++ {
+		ed.Dispatch(&events.ClickEvent{})
+	}
+	if store.Len() != 11 {
+		t.Fatalf("Expected 10 clicks and a burst, got %d records", store.Len())
+	}
+
+	replayer := events.NewEventDispatcher(store)
+	rules.New(replayer, rules.ClickBurst)
+	bursts := 0
+	replayer.Register("ClickBurst", func(event events.Event) { bursts++ })
+	store.ReadFrom(0, func(record *events.Record) error {
+		return replayer.Replay(record)
+	})
+	if bursts != 1 || store.Len() != 11 {
+		t.Errorf("Expected the stored burst to be replayed once and nothing new stored, got %d bursts and %d records", bursts, store.Len())
+	}
+}
+
+func TestDerivedEventsAreNotObserved(t *testing.T) {
+	store := eventstore.NewMemoryEventStore()
+	ed := events.NewEventDispatcher(store)
+	everything := rules.Rule{
+		Name:   "Everything",
+		Count:  1,
+		Window: time.Second,
+		Emit: func(m rules.Match) events.Event {
+			return &events.ClickBurstEvent{Clicks: len(m.Records)}
+		},
+	}
+	if _, err := rules.New(ed, everything); err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	// A rule matching all events fires for the click but not for the event it derived from it.
+	ed.Dispatch(&events.ClickEvent{})
+	if types := eventTypes(t, store); len(types) != 2 || types[0] != "Click" || types[1] != "ClickBurst" {
+		t.Errorf("Expected a click and one derived event, got %v", types)
+	}
+}
+
+func TestNewRejectsIncompleteRules(t *testing.T) {
+	if _, err := rules.New(events.NewEventDispatcher(nil), rules.Rule{Name: "Empty"}); err == nil {
+		t.Errorf("Expected an error for a rule without count, window and Emit")
+	}
+}
@@ -0,0 +1,191 @@
+package game
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"clicker2/game/events"
+)
+
+// DefaultSnapshotInterval is the number of events between two snapshots.
+const DefaultSnapshotInterval = 10000
+
+// Snapshot is a copy of the game state as of a sequence number in the event log.
+type Snapshot struct {
+	Sequence uint64          `json:"sequence"` // Last event included in State
+	Checksum string          `json:"checksum"` // SHA-256 of State, used to reject damaged snapshots
+	State    json.RawMessage `json:"state"`
+}
+
+// SnapshotStore keeps snapshots as JSON files next to an event log.
+// A log at "events.log" gets snapshots named "events.log.snapshot-<sequence>.json".
+type SnapshotStore struct {
+	logPath string
+}
+
+// NewSnapshotStore creates a SnapshotStore for the event log at logPath.
+func NewSnapshotStore(logPath string) *SnapshotStore {
+	return &SnapshotStore{logPath: logPath}
+}
+
+func (ss *SnapshotStore) path(sequence uint64) string {
+	return fmt.Sprintf("%s.snapshot-%020d.json", ss.logPath, sequence)
+}
+
+// List returns the paths of all snapshot files, oldest first.
+func (ss *SnapshotStore) List() ([]string, error) {
+	paths, err := filepath.Glob(ss.logPath + ".snapshot-*.json")
+	if err != nil {
+		return nil, err
+	}
+	// Sequences are zero-padded, so lexical order is sequence order.
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Save writes a snapshot of g tagged with the given sequence.
+// The file is written to a temporary path first so a crash never leaves a half-written snapshot.
+func (ss *SnapshotStore) Save(g *Game, sequence uint64) error {
+	state, err := json.Marshal(g)
+	if err != nil {
+		return fmt.Errorf("failed to marshal game state: %w", err)
+	}
+	sum := sha256.Sum256(state)
+	data, err := json.Marshal(&Snapshot{
+		Sequence: sequence,
+		Checksum: hex.EncodeToString(sum[:]),
+		State:    state,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+
+	path := ss.path(sequence)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// Latest returns the newest valid snapshot whose sequence does not exceed maxSequence.
+// Snapshots that cannot be read or fail their checksum are skipped.
+// It returns nil if there is no usable snapshot.
+func (ss *SnapshotStore) Latest(maxSequence uint64) (*Snapshot, error) {
+	paths, err := ss.List()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(paths) - 1; i >= 0; i-- {
+		snapshot, err := readSnapshot(paths[i])
+		if err != nil {
+			log.Printf("Skipping snapshot %s: %v", paths[i], err)
+			continue
+		}
+		if snapshot.Sequence > maxSequence {
+			continue // Ahead of the log, e.g. after the log was truncated
+		}
+		return snapshot, nil
+	}
+	return nil, nil
+}
+
+// Clear removes all snapshots.
+func (ss *SnapshotStore) Clear() error {
+	paths, err := ss.List()
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSnapshot(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(snapshot.State)
+	if hex.EncodeToString(sum[:]) != snapshot.Checksum {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+	return &snapshot, nil
+}
+
+// restore overwrites the game state with the state held in the snapshot.
+func (g *Game) restore(snapshot *Snapshot) error {
+	if err := json.Unmarshal(snapshot.State, g); err != nil {
+		return err
+	}
+	g.Upgrades.Init() // Re-initialize the upgrades map after loading
+	g.syncPhase()
+	g.Dispatcher.Resume(snapshot.Sequence)
+	return nil
+}
+
+// EnableSnapshots makes the game write a snapshot to ss every interval events.
+func (g *Game) EnableSnapshots(ss *SnapshotStore, interval uint64) {
+	g.snapshots = ss
+	g.snapshotInterval = interval
+	g.lastSnapshot = g.Dispatcher.LastSequence()
+}
+
+// maybeSnapshot writes a snapshot if snapshots are enabled and enough events passed since the last one.
+func (g *Game) maybeSnapshot() {
+	if g.snapshots == nil || g.snapshotInterval == 0 {
+		return
+	}
+	sequence := g.Dispatcher.LastSequence()
+	if sequence-g.lastSnapshot < g.snapshotInterval {
+		return
+	}
+	if err := g.snapshots.Save(g, sequence); err != nil {
+		log.Printf("Error saving snapshot at sequence %d: %v", sequence, err)
+		return
+	}
+	g.lastSnapshot = sequence
+}
+
+// RebuildSnapshots discards all snapshots in ss and recreates them by replaying es from the beginning,
+// writing one snapshot every interval events. It returns the number of snapshots written.
+func RebuildSnapshots(es events.EventStore, ss *SnapshotStore, interval uint64) (int, error) {
+	if interval == 0 {
+		return 0, fmt.Errorf("snapshot interval must be positive")
+	}
+	if err := ss.Clear(); err != nil {
+		return 0, fmt.Errorf("failed to clear snapshots: %w", err)
+	}
+
+	g := NewGame(nil) // Replay only, nothing is persisted
+	var lastSnapshot uint64
+	written := 0
+	err := es.ReadFrom(0, func(record *events.Record) error {
+		if err := g.replay(record); err != nil {
+			return err
+		}
+		if record.Sequence-lastSnapshot < interval {
+			return nil
+		}
+		if err := ss.Save(g, record.Sequence); err != nil {
+			return err
+		}
+		lastSnapshot = record.Sequence
+		written++
+		return nil
+	})
+	return written, err
+}
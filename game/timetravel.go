@@ -0,0 +1,239 @@
+package game
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"clicker2/game/events"
+)
+
+// DefaultCheckpointEvery is the number of events between two in-memory checkpoints of a Timeline.
+const DefaultCheckpointEvery = 1000
+
+// Timeline rebuilds the game as of any point in an event log, for debugging balance
+// and bug reports. It keeps the log in memory and steps through it in both directions;
+// stepping back restores the nearest earlier checkpoint and replays from there.
+type Timeline struct {
+	records         []*events.Record
+	checkpointEvery int
+	checkpoints     map[int][]byte // Game state after that many records
+	game            *Game
+	pos             int // Number of records applied to game
+}
+
+// NewTimeline reads every record of es and positions the timeline before the first one.
+func NewTimeline(es events.EventStore) (*Timeline, error) {
+	tl := &Timeline{
+		checkpointEvery: DefaultCheckpointEvery,
+		checkpoints:     make(map[int][]byte),
+		game:            newReadOnlyGame(),
+	}
+	err := es.ReadFrom(0, func(record *events.Record) error {
+		tl.records = append(tl.records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read event log: %w", err)
+	}
+	return tl, nil
+}
+
+// newReadOnlyGame creates a game for replaying only, which persists nothing and never writes the save file.
+func newReadOnlyGame() *Game {
+	g := NewGame(nil)
+	g.readOnly = true
+	return g
+}
+
+// SetCheckpointEvery sets the number of events between two checkpoints, DefaultCheckpointEvery
+// by default. Fewer events make stepping back faster at the cost of memory.
+func (tl *Timeline) SetCheckpointEvery(n int) {
+	if n <= 0 {
+		n = DefaultCheckpointEvery
+	}
+	tl.checkpointEvery = n
+	tl.checkpoints = make(map[int][]byte)
+}
+
+// Len returns the number of records in the timeline.
+func (tl *Timeline) Len() int {
+	return len(tl.records)
+}
+
+// Game returns the game as of the current position. It is replaced when the timeline
+// moves back, so it should not be kept across moves, and it persists nothing.
+func (tl *Timeline) Game() *Game {
+	return tl.game
+}
+
+// Record returns the last record applied to the game, nil before the first one.
+func (tl *Timeline) Record() *events.Record {
+	if tl.pos == 0 {
+		return nil
+	}
+	return tl.records[tl.pos-1]
+}
+
+// Seek moves to just after the last record with a sequence number of at most sequence.
+func (tl *Timeline) Seek(sequence uint64) error {
+	return tl.moveTo(sort.Search(len(tl.records), func(i int) bool {
+		return tl.records[i].Sequence > sequence
+	}))
+}
+
+// SeekTime moves to just after the last record dispatched at or before t.
+func (tl *Timeline) SeekTime(t time.Time) error {
+	return tl.moveTo(sort.Search(len(tl.records), func(i int) bool {
+		return tl.records[i].Timestamp.After(t)
+	}))
+}
+
+// Step applies the next record. It reports false at the end of the timeline.
+func (tl *Timeline) Step() (bool, error) {
+	if tl.pos == len(tl.records) {
+		return false, nil
+	}
+	return true, tl.moveTo(tl.pos + 1)
+}
+
+// Back undoes the last applied record. It reports false at the start of the timeline.
+func (tl *Timeline) Back() (bool, error) {
+	if tl.pos == 0 {
+		return false, nil
+	}
+	return true, tl.moveTo(tl.pos - 1)
+}
+
+// moveTo rebuilds the game after the first n records.
+func (tl *Timeline) moveTo(n int) error {
+	if n < tl.pos {
+		if err := tl.restoreCheckpoint(n); err != nil {
+			return err
+		}
+	}
+	for tl.pos < n {
+		record := tl.records[tl.pos]
+		if err := tl.game.Dispatcher.Replay(record); err != nil {
+			return fmt.Errorf("failed to replay record %d: %w", record.Sequence, err)
+		}
+		tl.pos++
+		if tl.pos%tl.checkpointEvery == 0 && tl.checkpoints[tl.pos] == nil {
+			state, err := json.Marshal(tl.game)
+			if err != nil {
+				return fmt.Errorf("failed to checkpoint game state: %w", err)
+			}
+			tl.checkpoints[tl.pos] = state
+		}
+	}
+	return nil
+}
+
+// restoreCheckpoint replaces the game with the newest checkpoint at or before n records.
+func (tl *Timeline) restoreCheckpoint(n int) error {
+	tl.game, tl.pos = newReadOnlyGame(), 0
+	for at := n - n%tl.checkpointEvery; at > 0; at -= tl.checkpointEvery {
+		state, ok := tl.checkpoints[at]
+		if !ok {
+			continue
+		}
+		if err := tl.game.restore(&Snapshot{Sequence: tl.records[at-1].Sequence, State: state}); err != nil {
+			return fmt.Errorf("failed to restore checkpoint: %w", err)
+		}
+		tl.pos = at
+		return nil
+	}
+	return nil
+}
+
+// State is the part of the game compared by Diff, as of an event.
+type State struct {
+	Sequence   uint64    // Last applied event, 0 before the first
+	Timestamp  time.Time // When that event was dispatched
+	Dust       int
+	Damage     int
+	RockHealth int
+	Upgrades   map[string]int // Upgrade levels
+}
+
+// State returns the state of the game at the current position.
+func (tl *Timeline) State() State {
+	s := State{
+		Dust:       tl.game.ThePlayer.Dust,
+		Damage:     tl.game.ThePlayer.Damage,
+		RockHealth: tl.game.TheRock.Health,
+		Upgrades:   make(map[string]int),
+	}
+	if record := tl.Record(); record != nil {
+		s.Sequence, s.Timestamp = record.Sequence, record.Timestamp
+	}
+	for id, level := range tl.game.Upgrades.PlayerUpgrades {
+		s.Upgrades[id] = level
+	}
+	return s
+}
+
+// Diff is the change between two states. Upgrades holds the level changes of the upgrades that changed.
+type Diff struct {
+	From, To   State
+	Dust       int
+	Damage     int
+	RockHealth int
+	Upgrades   map[string]int
+}
+
+// DiffStates returns the change from one state to another.
+func DiffStates(from, to State) *Diff {
+	d := &Diff{
+		From:       from,
+		To:         to,
+		Dust:       to.Dust - from.Dust,
+		Damage:     to.Damage - from.Damage,
+		RockHealth: to.RockHealth - from.RockHealth,
+		Upgrades:   make(map[string]int),
+	}
+	for id, level := range to.Upgrades {
+		if change := level - from.Upgrades[id]; change != 0 {
+			d.Upgrades[id] = change
+		}
+	}
+	for id, level := range from.Upgrades {
+		if _, ok := to.Upgrades[id]; !ok && level != 0 {
+			d.Upgrades[id] = -level
+		}
+	}
+	return d
+}
+
+// Diff returns the change between the states after the events with sequence numbers from and to,
+// and leaves the timeline at to.
+func (tl *Timeline) Diff(from, to uint64) (*Diff, error) {
+	if err := tl.Seek(from); err != nil {
+		return nil, err
+	}
+	before := tl.State()
+	if err := tl.Seek(to); err != nil {
+		return nil, err
+	}
+	return DiffStates(before, tl.State()), nil
+}
+
+// String lists the changes, one per line.
+func (d *Diff) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "sequence %d -> %d\n", d.From.Sequence, d.To.Sequence)
+	fmt.Fprintf(&b, "dust: %d -> %d (%+d)\n", d.From.Dust, d.To.Dust, d.Dust)
+	fmt.Fprintf(&b, "damage: %d -> %d (%+d)\n", d.From.Damage, d.To.Damage, d.Damage)
+	fmt.Fprintf(&b, "rock health: %d -> %d (%+d)\n", d.From.RockHealth, d.To.RockHealth, d.RockHealth)
+	ids := make([]string, 0, len(d.Upgrades))
+	for id := range d.Upgrades {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		fmt.Fprintf(&b, "upgrade %s: %d -> %d (%+d)\n", id, d.From.Upgrades[id], d.To.Upgrades[id], d.Upgrades[id])
+	}
+	return b.String()
+}
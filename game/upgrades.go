@@ -4,9 +4,6 @@ import (
 	"clicker2/game/errors" // Import the new errors package
 )
 
-// Effect is a function that applies an upgrade to the game state.
-type Effect func(g *Game)
-
 // CostFunc is a function that calculates the cost of an upgrade, potentially based on its level.
 type CostFunc func(level int) int
 
@@ -17,8 +14,7 @@ type Upgrade struct {
 	Description string
 	MaxLevel    int
 	Cost        CostFunc
-	ApplyEffect Effect // Applied when purchased
-	ReconstructEffect func(g *Game, level int) // Applied during event replay
+	ReconstructEffect func(g *Game, level int) // Sets the state for a level, whenever a purchase or refund is applied
 }
 
 // UpgradeManager manages all upgrades in the game.
@@ -51,9 +47,6 @@ func (um *UpgradeManager) registerUpgrades() {
 		Description: "Increases click damage by 1.",
 		MaxLevel:    5,
 		Cost:        func(level int) int { return 10 * (level + 1) },
-		ApplyEffect: func(g *Game) {
-			g.ThePlayer.Damage++
-		},
 		ReconstructEffect: func(g *Game, level int) {
 			g.ThePlayer.Damage = 1 + level // Base damage + level
 		},
@@ -65,14 +58,13 @@ func (um *UpgradeManager) registerUpgrades() {
 		Description: "Enables a basic auto-clicker. Can be toggled.",
 		MaxLevel:    1,
 		Cost:        func(level int) int { return 100 },
-		ApplyEffect: func(g *Game) {
-			g.AutoClickerActive = true
-			g.AutoClickerRate = 1
-		},
 		ReconstructEffect: func(g *Game, level int) {
 			if level > 0 {
 				g.AutoClickerActive = true
 				g.AutoClickerRate = 1
+			} else if g.Upgrades.PlayerUpgrades["auto_clicker_v1_0"] == 0 { // Refunded
+				g.AutoClickerActive = false
+				g.AutoClickerRate = 0
 			}
 		},
 	})
@@ -83,15 +75,16 @@ func (um *UpgradeManager) registerUpgrades() {
 		Description: "Upgrades the auto-clicker to be permanent and faster.",
 		MaxLevel:    1,
 		Cost:        func(level int) int { return 500 },
-		ApplyEffect: func(g *Game) {
-			g.AutoClickerActive = true
-			g.AutoClickerRate = 5 // Increase rate
-			// In a real game, this would also disable the toggle UI
-		},
 		ReconstructEffect: func(g *Game, level int) {
 			if level > 0 {
 				g.AutoClickerActive = true
 				g.AutoClickerRate = 5
+			} else if g.Upgrades.PlayerUpgrades["auto_clicker_v0_1"] > 0 { // Refunded, back to the basic auto-clicker
+				g.AutoClickerActive = true
+				g.AutoClickerRate = 1
+			} else { // Refunded
+				g.AutoClickerActive = false
+				g.AutoClickerRate = 0
 			}
 		},
 	})
@@ -102,14 +95,9 @@ func (um *UpgradeManager) registerUpgrades() {
 		Description: "The ultimate choice. Purchase to decide the rock's fate.",
 		MaxLevel:    1,
 		Cost:        func(level int) int { return 100000 }, // Very high cost
-		ApplyEffect: func(g *Game) {
-			g.EndGameChoicePending = true
-			g.CurrentRockMessage = "You have reached the Heart of the Mountain. The rock is now still. It has given all it can. You have gathered enough. Will you take the final piece, or will you let it rest?"
-			g.RockMessageTimer = -1.0 // Display indefinitely until choice is made
-		},
 		ReconstructEffect: func(g *Game, level int) {
 			if level > 0 {
-				g.EndGameChoicePending = true
+				g.setPhase(PhaseChoicePending)
 				g.CurrentRockMessage = "You have reached the Heart of the Mountain. The rock is now still. It has given all it can. You have gathered enough. Will you take the final piece, or will you let it rest?"
 				g.RockMessageTimer = -1.0
 			}
@@ -0,0 +1,123 @@
+package game
+
+import (
+	stderrors "errors"
+	"fmt"
+
+	"clicker2/game/errors"
+	"clicker2/game/events"
+)
+
+// Violation describes an event that breaks a rule of the game, e.g. in a corrupt or hand-edited log.
+type Violation struct {
+	Sequence  uint64
+	EventType string
+	Invariant string // The rule that is broken
+	Want, Got int
+}
+
+func (v *Violation) Error() string {
+	return fmt.Sprintf("%s event %d: %s: want %d, got %d", v.EventType, v.Sequence, v.Invariant, v.Want, v.Got)
+}
+
+// Verify replays es and checks every event against the state of the game before it:
+// before-values must match the state, clicks must deal the player's damage, and purchases
+// and refunds must cost and give back what the upgrade's CostFunc says. It returns the number of records checked and,
+// for the first broken rule, an ErrInvariantViolated error wrapping a *Violation. A record that cannot be read,
+// e.g. one that fails its checksum or a torn tail, fails the verification with the error of the store.
+// Verify only reads es; a FileEventStore is not recovered, so its corrupt tail is reported rather than removed.
+func Verify(es events.EventStore) (int, *errors.GameError) {
+	g := newReadOnlyGame()
+	checked := 0
+	var lastSequence uint64
+	err := es.ReadFrom(0, func(record *events.Record) error {
+		if checked > 0 && record.Sequence <= lastSequence {
+			return newViolation(record, "sequence numbers increase", int(lastSequence+1), int(record.Sequence))
+		}
+		if v := g.check(record); v != nil {
+			return v
+		}
+		if err := g.Dispatcher.Replay(record); err != nil {
+			return err
+		}
+		lastSequence = record.Sequence
+		checked++
+		return nil
+	})
+	if err == nil {
+		return checked, nil
+	}
+	var v *Violation
+	if stderrors.As(err, &v) {
+		return checked, errors.WrapGameError(errors.ErrInvariantViolated, v)
+	}
+	return checked, errors.WrapGameError(errors.AsGameError(err).Code, err, "failed to verify event log")
+}
+
+func newViolation(record *events.Record, invariant string, want, got int) *Violation {
+	return &Violation{Sequence: record.Sequence, EventType: record.Event.EventType(), Invariant: invariant, Want: want, Got: got}
+}
+
+// check returns the first rule the record breaks given the current state, or nil.
+func (g *Game) check(record *events.Record) *Violation {
+	var v *Violation
+	expect := func(invariant string, want, got int) {
+		if v == nil && want != got {
+			v = newViolation(record, invariant, want, got)
+		}
+	}
+	health, dust, damage := g.TheRock.Health, g.ThePlayer.Dust, g.ThePlayer.Damage
+
+	switch e := record.Event.(type) {
+	case *events.ClickEvent:
+		expect("RockHealthBefore matches the rock's health", health, e.RockHealthBefore)
+		expect("PlayerDustBefore matches the player's dust", dust, e.PlayerDustBefore)
+		expect("DamageDealt matches the player's damage", damage, e.DamageDealt)
+		expect("DustGained is one per click", 1, e.DustGained)
+		expect("RockHealthAfter is RockHealthBefore minus DamageDealt", e.RockHealthBefore-e.DamageDealt, e.RockHealthAfter)
+		expect("PlayerDustAfter is PlayerDustBefore plus DustGained", e.PlayerDustBefore+e.DustGained, e.PlayerDustAfter)
+	case *events.ClicksAggregatedEvent:
+		expect("RockHealthBefore matches the rock's health", health, e.RockHealthBefore)
+		expect("PlayerDustBefore matches the player's dust", dust, e.PlayerDustBefore)
+		expect("TotalDamage is the player's damage for every click", e.Clicks*damage, e.TotalDamage)
+		expect("TotalDust is one per click", e.Clicks, e.TotalDust)
+		expect("RockHealthAfter is RockHealthBefore minus TotalDamage", e.RockHealthBefore-e.TotalDamage, e.RockHealthAfter)
+		expect("PlayerDustAfter is PlayerDustBefore plus TotalDust", e.PlayerDustBefore+e.TotalDust, e.PlayerDustAfter)
+	case *events.UpgradePurchasedEvent:
+		upgrade, err := g.Upgrades.GetUpgrade(e.UpgradeID)
+		if err != nil {
+			return newViolation(record, "upgrade "+e.UpgradeID+" exists", 1, 0)
+		}
+		level := g.Upgrades.PlayerUpgrades[e.UpgradeID]
+		cost := upgrade.Cost(level)
+		expect("NewLevel is one above the current level", level+1, e.NewLevel)
+		if e.NewLevel > upgrade.MaxLevel {
+			expect("NewLevel does not exceed MaxLevel", upgrade.MaxLevel, e.NewLevel)
+		}
+		if e.OldDust != 0 { // Not recorded by older versions
+			expect("OldDust matches the player's dust", dust, e.OldDust)
+		}
+		if dust < cost {
+			expect("the player can afford the upgrade", cost, dust)
+		}
+		expect("NewDust is the player's dust minus the upgrade cost", dust-cost, e.NewDust)
+	case *events.PurchaseRefundedEvent:
+		upgrade, err := g.Upgrades.GetUpgrade(e.UpgradeID)
+		if err != nil {
+			return newViolation(record, "upgrade "+e.UpgradeID+" exists", 1, 0)
+		}
+		if e.UpgradeID == "heart_of_the_mountain" {
+			expect("the Heart of the Mountain is not refunded", 0, 1)
+		}
+		level := g.Upgrades.PlayerUpgrades[e.UpgradeID]
+		expect("NewLevel is one below the current level", level-1, e.NewLevel)
+		expect("OldDust matches the player's dust", dust, e.OldDust)
+		expect("NewDust is the player's dust plus the upgrade cost", dust+upgrade.Cost(e.NewLevel), e.NewDust)
+	case *events.HeartTakenEvent, *events.MountainRestedEvent:
+		expect("the Heart of the Mountain was purchased", 1, g.Upgrades.PlayerUpgrades["heart_of_the_mountain"])
+		if g.Phase == PhaseWon || g.Phase == PhaseLost {
+			expect("the game has not ended", 0, 1)
+		}
+	}
+	return v
+}
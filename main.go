@@ -4,11 +4,16 @@ import (
 	"clicker2/assets"
 	"clicker2/game"
 	"clicker2/game/clickanalysis"
+	"clicker2/game/errors"
+	"clicker2/game/events"
+	"clicker2/game/eventstore"
 	"clicker2/game/hud"
+	"clicker2/game/rules"
 	"clicker2/shaders"
 	"image"
 	"image/color" // Import for color
 	"log"
+	"os"
 
 	"golang.org/x/image/font/basicfont" // Import for basic font
 	"github.com/hajimehoshi/ebiten/v2"
@@ -146,7 +151,10 @@ func (g *EbitenGame) handleMouseInput() {
 		// Check for rock click
 		rockBounds := image.Rectangle{Min: g.rockPos, Max: g.rockPos.Add(g.currentRockSprite.Bounds().Size())}
 		if cursorPoint.In(rockBounds) {
-			g.state.Click()
+			if err := g.state.Click(); err != nil {
+				log.Printf("Error clicking the rock: %v", err)
+				return
+			}
 			g.clickGrid.AddClick(cursorPoint.X, cursorPoint.Y, screenWidth, screenHeight)
 			g.lastMouseX = float32(cursorPoint.X) / float32(screenWidth)
 			g.lastMouseY = float32(cursorPoint.Y) / float32(screenHeight)
@@ -169,15 +177,19 @@ func (g *EbitenGame) handleMouseInput() {
 		}	}
 
 	// Handle end-game choices
-	if g.state.EndGameChoicePending {
+	if g.state.Phase == game.PhaseChoicePending {
 		if inpututil.IsMouseButtonJustPressed(ebiten.MouseButtonLeft) {
 			x, y := ebiten.CursorPosition()
 			cursorPoint := image.Point{X: x, Y: y}
 			if clickedChoiceID := g.hud.GetClickedChoiceID(cursorPoint); clickedChoiceID != "" {
+				var err *errors.GameError
 				if clickedChoiceID == "take_heart" {
-					g.state.TakeHeart()
+					err = g.state.TakeHeart()
 				} else if clickedChoiceID == "let_rest" {
-					g.state.LetRest()
+					err = g.state.LetRest()
+				}
+				if err != nil {
+					log.Printf("Error making the end-game choice %s: %v", clickedChoiceID, err)
 				}
 				return
 			}
@@ -221,6 +233,15 @@ func (g *EbitenGame) handleGameKeybinds() {
 		}
 	}
 
+	// Undo a misclicked purchase
+	if inpututil.IsKeyJustPressed(ebiten.KeyU) {
+		if err := g.state.RefundLastPurchase(); err != nil {
+			log.Printf("Error refunding purchase: %v", err)
+		} else {
+			log.Println("Purchase refunded!")
+		}
+	}
+
 	// Toggle shaders
 	if inpututil.IsKeyJustPressed(ebiten.KeySpace) {
 		g.shadersEnabled = !g.shadersEnabled
@@ -327,6 +348,7 @@ func (g *EbitenGame) Shortcuts() []string {
 		"Q: Quit Game",
 		"S: Save Game",
 		"L: Load Game",
+		"U: Undo Last Purchase",
 		"Scroll: Adjust Music Volume",
 		"Space: Toggle Shaders",
 		"--- Developer Shortcuts ---",
@@ -349,7 +371,48 @@ func main() {
 	marketplaceY := screenHeight/2 - 128/2
 
 	// Initialize game state
-	gameState := game.NewGame()
+	logPath := "events.log"
+	if path := os.Getenv("CLICKER2_EVENT_LOG"); path != "" { // E.g. a log forked with eventtool
+		logPath = path
+	}
+	key := os.Getenv("CLICKER2_SIGNING_KEY")
+	opts := eventstore.DefaultFileStoreOptions
+	// Collapse the clicks of each full segment while playing; a signed log must stay as it was signed
+	opts.CompactSealed = key == ""
+	fileStore := eventstore.NewFileEventStoreWithOptions(logPath, opts)
+	// Remove a tail left by a crash before the log is read, as reading leaves it alone
+	if err := fileStore.Recover(); err != nil {
+		log.Fatal(err)
+	}
+	var store events.EventStore = fileStore
+	// Sign the event log and the save file so edits to them are detected
+	if key != "" {
+		signed := eventstore.NewSignedEventStore(store, []byte(key))
+		if err := signed.Verify(); err != nil {
+			log.Fatalf("Event log %s failed its signature check, it may have been tampered with: %v", logPath, err)
+		}
+		store = signed
+		game.SaveKey = []byte(key)
+	}
+	// Play on from the state the log ends in, so every session continues the one before it.
+	// Snapshots next to the log spare replaying it from the start.
+	snapshots := game.NewSnapshotStore(logPath)
+	gameState, gerr := game.LoadGameFromSnapshot(store, snapshots)
+	if gerr != nil {
+		log.Fatal(gerr)
+	}
+	gameState.EnableSnapshots(snapshots, game.DefaultSnapshotInterval)
+	fork, err := eventstore.ReadForkInfo(logPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if fork != nil {
+		log.Printf("Playing %s, forked from %s at sequence %d", logPath, fork.Parent, fork.Sequence)
+	}
+	// Derive events such as click bursts from the clicks
+	if _, err := rules.New(gameState.Dispatcher, rules.DefaultRules...); err != nil {
+		log.Fatal(err)
+	}
 
 	// Initialize HUD
 	gameHUD := hud.NewHUD(screenWidth, screenHeight, gameState.Upgrades)
@@ -381,7 +444,13 @@ func main() {
 
 	ebiten.SetWindowSize(screenWidth, screenHeight)
 	ebiten.SetWindowTitle("Clicker2")
-	if err := ebiten.RunGame(game); err != nil {
+	err = ebiten.RunGame(game) // Returns nil once Update returns ebiten.Termination
+
+	// Flush buffered events before exiting
+	if closeErr := gameState.Close(); closeErr != nil {
+		log.Printf("Error closing event store: %v", closeErr)
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }